@@ -3,8 +3,11 @@ module github.com/thockin/go2make
 go 1.19
 
 require (
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
-	golang.org/x/tools v0.1.12 // indirect
+	github.com/google/go-cmp v0.5.8
+	github.com/lithammer/dedent v1.1.0
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4
+	golang.org/x/tools v0.1.12
 )
+
+require golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
@@ -17,23 +17,23 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
-	"golang.org/x/tools/go/packages"
+	"github.com/thockin/go2make/pkg/go2make"
 )
 
 var flHelp = pflag.BoolP("help", "h", false, "print help and exit")
 var flDbg = pflag.BoolP("debug", "d", false, "enable debugging output")
 var flDbgTime = pflag.BoolP("debug-time", "D", false, "enable debugging output with timestamps")
-var flOut = pflag.StringP("output", "o", "make", "output format (mainly for debugging): one of make | json)")
+var flOut = pflag.StringP("output", "o", "make", "output format: one of make | compile (experimental) | ninja | bazel | dot | mermaid | graphml | cyclonedx | spdx | json | ndjson | json-raw")
+var flTemplate = pflag.String("template", "", "a Go text/template file to execute instead of using --output")
 var flRoots = pflag.StringSlice("root", nil, "only process packages under specific prefixes (may be specified multiple times)")
 var flPrune = pflag.StringSlice("prune", nil, "package prefixes to prune (recursive, may be specified multiple times)")
 var flTags = pflag.StringSlice("tag", nil, "build tags to pass to Go (see 'go help build', may be specified multiple times)")
@@ -41,6 +41,18 @@ var flRelPath = pflag.String("relative-to", ".", "emit by-path rules for package
 var flImports = pflag.Bool("imports", false, "process all imports of all packages, recursively")
 var flStateDir = pflag.String("state-dir", ".go2make", "directory in which to store state used by make")
 var flIgnoreErrors = pflag.BoolP("ignore-errors", "e", false, "ignore package errors")
+var flIgnoreErrorKinds = pflag.StringSlice("ignore-error-kind", nil, "ignore package errors of this kind: one of list | parse | type | unknown (may be specified multiple times)")
+var flIgnoreErrorsIn = pflag.StringSlice("ignore-errors-in", nil, "ignore package errors in packages under these prefixes, or in their files (may be specified multiple times)")
+var flPartial = pflag.Bool("partial", false, "emit failing _pkg rules for packages with errors, rather than failing (make and compile only)")
+var flTests = pflag.Bool("tests", false, "also process package tests and emit _test rules")
+var flPlatforms = pflag.StringSlice("platform", nil, "GOOS/GOARCH pairs to process, each in its own state dir (may be specified multiple times)")
+var flTagSets = pflag.StringArray("tag-set", nil, "named sets of build tags to process, each in its own state dir, as <name>:<tag>,<tag> (may be specified multiple times)")
+var flBinaries = pflag.Bool("binaries", false, "also emit rules to build main packages into $(GO2MAKE_BIN_DIR)")
+var flGraphColor = pflag.String("graph-color", "none", "for graph outputs, which packages to color: one of none | root | prune")
+var flGraphCollapseStd = pflag.Bool("graph-collapse-std", false, "for graph outputs, show the standard library as a single node")
+var flErrorsFormat = pflag.String("errors-format", "text", "how to report errors: one of text | json")
+var flErrorsFile = pflag.String("errors-file", "", "write errors to this file instead of stderr")
+var flStampMode = pflag.String("stamp-mode", "mtime", "how stamps decide they are out of date: one of mtime | hash")
 
 var lastDebugTime time.Time
 
@@ -63,14 +75,8 @@ func debug(items ...interface{}) {
 
 }
 
-type emitter struct {
-	roots        []string
-	prune        []string
-	tags         []string
-	ignoreErrors bool
-	relPath      string
-	imports      bool
-	stateDir     string
+func warn(msg string) {
+	fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
 }
 
 func main() {
@@ -85,63 +91,156 @@ func main() {
 		*flDbg = true
 	}
 
-	switch *flOut {
-	case "make":
-	case "json":
+	switch *flErrorsFormat {
+	case "text", "json":
 	default:
-		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *flOut)
+		fmt.Fprintf(os.Stderr, "unknown errors format %q\n", *flErrorsFormat)
 		pflag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	if *flRelPath == "" {
-		fmt.Fprintf(os.Stderr, "error: --relative-to must be defined\n")
-		os.Exit(1)
+	var emitter go2make.Emitter
+	if *flTemplate != "" {
+		if pflag.CommandLine.Changed("output") {
+			fmt.Fprintf(os.Stderr, "error: --template and --output are mutually exclusive\n")
+			os.Exit(1)
+		}
+		e, err := go2make.NewTemplateEmitter(*flTemplate)
+		if err != nil {
+			fail(err, nil)
+		}
+		emitter = e
+	} else {
+		e, err := go2make.NewEmitter(*flOut)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			pflag.Usage()
+			os.Exit(1)
+		}
+		if !go2make.SupportsVariants(*flOut) && (len(*flPlatforms) > 0 || len(*flTagSets) > 0) {
+			fmt.Fprintf(os.Stderr, "error: --output=%s does not support --platform or --tag-set\n", *flOut)
+			os.Exit(1)
+		}
+		emitter = e
 	}
-
-	if *flStateDir == "" {
-		fmt.Fprintf(os.Stderr, "error: --state-dir must be defined\n")
-		os.Exit(1)
+	if *flPartial && (*flTemplate != "" || (*flOut != "make" && *flOut != "compile")) {
+		fmt.Fprintf(os.Stderr, "error: --partial is only supported by --output=make and --output=compile\n")
+		os.Exit(exitUsage)
 	}
 
-	targets := pflag.Args()
-	if len(targets) == 0 {
-		targets = append(targets, ".")
+	opts := go2make.Options{
+		Roots:            *flRoots,
+		Prune:            *flPrune,
+		Tags:             *flTags,
+		IgnoreErrors:     *flIgnoreErrors,
+		IgnoreErrorKinds: *flIgnoreErrorKinds,
+		IgnoreErrorsIn:   *flIgnoreErrorsIn,
+		Partial:          *flPartial,
+		RelativeTo:       *flRelPath,
+		Imports:          *flImports,
+		StateDir:         *flStateDir,
+		Tests:            *flTests,
+		Binaries:         *flBinaries,
+		Compile:          *flOut == "compile",
+		Deps:             *flOut == "cyclonedx" || *flOut == "spdx",
+		Platforms:        *flPlatforms,
+		TagSets:          *flTagSets,
+		GraphColor:       *flGraphColor,
+		GraphCollapseStd: *flGraphCollapseStd,
+		StampMode:        *flStampMode,
+		Warn:             warn,
 	}
-	debug("targets:", targets)
-
-	// Gather flag values for easier testing.
-	emit := emitter{
-		roots:        forEach(*flRoots, dropTrailingSlash),
-		prune:        forEach(*flPrune, dropTrailingSlash),
-		tags:         *flTags,
-		ignoreErrors: *flIgnoreErrors,
-		relPath:      dropTrailingSlash(absOrExit(*flRelPath)),
-		imports:      *flImports,
-		stateDir:     dropTrailingSlash(*flStateDir),
+	if *flDbg {
+		opts.Debug = debug
 	}
-	debug("roots:", emit.roots)
-	debug("prune:", emit.prune)
-	debug("tags:", emit.tags)
-	debug("relative-to:", emit.relPath)
-
-	pkgs, err := emit.loadPackages(targets...)
+	graph, err := go2make.Load(opts, pflag.Args()...)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error loading packages: %v\n", err)
-		os.Exit(1)
+		var ignored go2make.PackageErrors
+		if graph != nil {
+			ignored = graph.IgnoredErrors()
+		}
+		fail(err, ignored)
+	}
+	if err := emitter.Emit(os.Stdout, graph); err != nil {
+		fail(err, graph.IgnoredErrors())
+	}
+	// With --partial, broken packages are reported, but the output is still
+	// usable.
+	var broken error
+	if errs := graph.BrokenErrors(); len(errs) > 0 {
+		broken = errs
+	}
+	if err := reportErrors(broken, graph.IgnoredErrors()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: can't report errors: %v\n", err)
+		os.Exit(exitOutputError)
+	}
+}
+
+// Exit codes, so callers can tell failures apart.
+const (
+	exitUsage       = 1 // bad flags or options
+	exitLoadError   = 2 // packages could not be loaded at all
+	exitPkgErrors   = 3 // some packages have errors
+	exitOutputError = 4 // output could not be generated or written
+)
+
+// fail reports err, and any errors which were ignored, and exits with the
+// matching code.
+func fail(err error, ignored go2make.PackageErrors) {
+	code := exitUsage
+	var loadErr *go2make.LoadError
+	var pkgErrs go2make.PackageErrors
+	var emitErr *go2make.EmitError
+	switch {
+	case errors.As(err, &pkgErrs):
+		code = exitPkgErrors
+	case errors.As(err, &loadErr):
+		code = exitLoadError
+	case errors.As(err, &emitErr):
+		code = exitOutputError
+	}
+	if rerr := reportErrors(err, ignored); rerr != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: can't report errors: %v\n", rerr)
 	}
+	os.Exit(code)
+}
 
-	pkgMap := emit.visitPackages(pkgs)
-	if pkgMap == nil {
-		os.Exit(1)
+// reportErrors writes err, which may be nil, and a summary of the errors
+// which were ignored, in the --errors-format to the --errors-file or stderr.
+// When there is an --errors-file, it is always written, so it is never stale.
+func reportErrors(err error, ignored go2make.PackageErrors) error {
+	out := io.Writer(os.Stderr)
+	if *flErrorsFile != "" {
+		f, ferr := os.Create(*flErrorsFile)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+		out = f
+	} else if err == nil && len(ignored) == 0 {
+		return nil
 	}
 
-	switch *flOut {
-	case "make":
-		emit.emitMake(os.Stdout, pkgMap)
-	case "json":
-		emit.emitJSON(os.Stdout, pkgMap)
+	if *flErrorsFormat == "json" {
+		return go2make.WriteErrorsJSON(out, err, ignored)
 	}
+	bw := bufio.NewWriter(out)
+	var pkgErrs go2make.PackageErrors
+	if errors.As(err, &pkgErrs) {
+		for _, e := range pkgErrs {
+			fmt.Fprintf(bw, "%v\n", e)
+		}
+	} else if err != nil {
+		fmt.Fprintf(bw, "error: %v\n", err)
+	}
+	if len(ignored) > 0 {
+		fmt.Fprintf(bw, "warning: ignored %d package error(s):\n", len(ignored))
+		for _, e := range ignored {
+			fmt.Fprintf(bw, "    %s: %v\n", e.PkgPath, e)
+		}
+	}
+	return bw.Flush()
 }
 
 func help(out io.Writer) {
@@ -172,211 +271,113 @@ func help(out io.Writer) {
 	fmt.Fprintf(out, "example.com/txt/color).  The 'by-path/.../_pkg' rules are defined by the relative path of the\n")
 	fmt.Fprintf(out, "Go package when that path is below the value of the --relative-to flag.\n")
 	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Every package also depends on a '_toolchain' rule, which is a fingerprint of the Go\n")
+	fmt.Fprintf(out, "toolchain, its environment (see 'go env'), and the build tags.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Every package in a module also depends on a 'by-mod/.../_mod' rule, which is defined by\n")
+	fmt.Fprintf(out, "the module's go.mod, go.sum, vendor/modules.txt, and go.work files.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --platform is specified, packages are processed once per platform and the rules for\n")
+	fmt.Fprintf(out, "each are emitted under a per-platform state dir (e.g. '.go2make/linux_arm64/by-pkg/...').\n")
+	fmt.Fprintf(out, "The variables GO2MAKE_BY_PKG_PLATFORM and GO2MAKE_BY_PATH_PLATFORM take the platform as\n")
+	fmt.Fprintf(out, "their first argument.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Packages in the main module(s) which have //go:generate directives, including in their\n")
+	fmt.Fprintf(out, "_test.go files, also get a '_generate' rule (e.g. '.go2make/by-pkg/<pkg>/_generate')\n")
+	fmt.Fprintf(out, "which runs 'go generate' for the package.  It depends on the package's files, any files\n")
+	fmt.Fprintf(out, "named as arguments to the generators, and the '_pkg' of any generator which is run from\n")
+	fmt.Fprintf(out, "this repo via 'go run'.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --binaries is specified, rules are also emitted to build each main package\n")
+	fmt.Fprintf(out, "into $(GO2MAKE_BIN_DIR) (default 'bin'), and GO2MAKE_BINARIES lists them all.  The build\n")
+	fmt.Fprintf(out, "command is $(GO2MAKE_GO_BUILD) and linker flags come from $(GO2MAKE_LDFLAGS) and\n")
+	fmt.Fprintf(out, "$(GO2MAKE_LDFLAGS_<name>).  Binaries for other platforms or tag sets go into subdirs.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=ninja is specified, the output is a ninja file with the same '_files',\n")
+	fmt.Fprintf(out, "'_pkg', 'by-path' and '_test' stamps.  Rules which only update their output when it\n")
+	fmt.Fprintf(out, "changes use 'restat = 1'.  Generate and binary rules are only emitted for make.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=bazel is specified, a BUILD.bazel file with a go_library or go_binary\n")
+	fmt.Fprintf(out, "(and go_test, with --tests) is written into the directory of each package in the main\n")
+	fmt.Fprintf(out, "module(s), and the names of the files which changed are printed.  Labels are relative\n")
+	fmt.Fprintf(out, "to --relative-to, and other modules are named like '@com_github_foo_bar//pkg'.  Lines\n")
+	fmt.Fprintf(out, "between '# go2make:keep-begin' and '# go2make:keep-end' are preserved.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=dot is specified, the output is a Graphviz digraph of the packages and\n")
+	fmt.Fprintf(out, "their imports, clustered by module.  Imports which were not processed (e.g. because of\n")
+	fmt.Fprintf(out, "--root or --prune) are dashed.  --graph-color=root colors the processed packages under\n")
+	fmt.Fprintf(out, "--root, --graph-color=prune colors the pruned ones, and --graph-collapse-std shows the\n")
+	fmt.Fprintf(out, "standard library as one node.  --output=mermaid and --output=graphml are the same\n")
+	fmt.Fprintf(out, "graph, as a Mermaid flowchart or as GraphML with module, version, files (the number\n")
+	fmt.Fprintf(out, "of Go files), dir (only if under --relative-to), boundary and color attributes on each\n")
+	fmt.Fprintf(out, "node.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=json is specified, the output is a JSON object with a 'schemaVersion'\n")
+	fmt.Fprintf(out, "and a sorted list of 'packages', each with pkgPath, name, dir, relDir, files (by kind),\n")
+	fmt.Fprintf(out, "imports, module and the paths of its stamps.  With --platform or --tag-set, there is a\n")
+	fmt.Fprintf(out, "list of 'variants' instead, each with its own 'packages'.  See the README for details.\n")
+	fmt.Fprintf(out, "With --tests, each package is followed by its test variants, which have 'kind' \"test\".\n")
+	fmt.Fprintf(out, "--output=ndjson emits the same package records in the same order, written one per line\n")
+	fmt.Fprintf(out, "instead of as one big JSON document.  Each also has 'schemaVersion' and, if needed,\n")
+	fmt.Fprintf(out, "'goos', 'goarch' and 'tagSet'.\n")
+	fmt.Fprintf(out, "--output=json-raw emits the packages as returned by go/packages, which is not stable.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=cyclonedx or --output=spdx is specified, a software bill of materials is\n")
+	fmt.Fprintf(out, "emitted for each main package, one JSON document per line.  It lists every module which\n")
+	fmt.Fprintf(out, "the package links, with its version, replacement and go.sum hash.  Hashes which are not in\n")
+	fmt.Fprintf(out, "go.sum or go.work.sum are read from the module cache.  Packages are loaded with GOPROXY=off,\n")
+	fmt.Fprintf(out, "so the network is never used and every module must already be in the module cache.  Set\n")
+	fmt.Fprintf(out, "SOURCE_DATE_EPOCH for reproducible timestamps.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --template is specified, the named Go text/template is executed instead of using\n")
+	fmt.Fprintf(out, "--output, once per platform and tag set.  The data has SchemaVersion, StateDir,\n")
+	fmt.Fprintf(out, "RelativeTo, GOOS, GOARCH, TagSet, Tags and Packages, which are the same as the JSON\n")
+	fmt.Fprintf(out, "output's package records, with Go field names (e.g. .PkgPath, .Files.Go, .Stamps.Pkg).\n")
+	fmt.Fprintf(out, "Helpers: rel (a path relative to --relative-to), makeEscape, topo (packages with\n")
+	fmt.Fprintf(out, "imports first), pkg (look up a package by path), join, base and dir.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --output=compile is specified (experimental), the output also has rules which\n")
+	fmt.Fprintf(out, "compile each pure-Go package in the main module(s) with 'go tool compile' into\n")
+	fmt.Fprintf(out, "'.go2make/by-pkg/<pkg>/_pkg.a', and link each main package with 'go tool link' into\n")
+	fmt.Fprintf(out, "$(GO2MAKE_BIN_DIR).  Other packages are compiled by 'go list -export' when go2make runs,\n")
+	fmt.Fprintf(out, "and their archives are used from the Go build cache.  Main packages which can't be\n")
+	fmt.Fprintf(out, "compiled this way (e.g. they use cgo, assembly or embedded files) are built with\n")
+	fmt.Fprintf(out, "$(GO2MAKE_GO_BUILD), as with --binaries.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --tag-set is specified, packages are processed once per named set of tags and the\n")
+	fmt.Fprintf(out, "rules for each are emitted under a per-set state dir (e.g. '.go2make/integration/by-pkg/...').\n")
+	fmt.Fprintf(out, "Packages which are the same in every set share one set of rules.  The variables\n")
+	fmt.Fprintf(out, "GO2MAKE_BY_PKG_TAG_SET and GO2MAKE_BY_PATH_TAG_SET take the set name as their first argument.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --stamp-mode=hash is specified, stamp files hold a hash of their inputs and are only\n")
+	fmt.Fprintf(out, "touched when that changes, rather than whenever any input is newer.  The hash command\n")
+	fmt.Fprintf(out, "can be set via the GO2MAKE_HASH variable.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --tests is specified, 'by-pkg/.../_test' and 'by-path/.../_test' rules are also\n")
+	fmt.Fprintf(out, "emitted.  These depend on the package's test files, its test-only imports, and the\n")
+	fmt.Fprintf(out, "package's own '_pkg' rule.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Package errors fail the run, unless they are ignored.  --ignore-errors ignores all of them,\n")
+	fmt.Fprintf(out, "--ignore-error-kind ignores errors of a kind (e.g. 'list' for missing packages), and\n")
+	fmt.Fprintf(out, "--ignore-errors-in ignores errors in packages under a prefix, or in their files (e.g. an\n")
+	fmt.Fprintf(out, "import of a missing package).  Errors which were ignored are summarized at the end, or\n")
+	fmt.Fprintf(out, "listed with \"ignored\": true in JSON.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --partial is specified, packages with errors do not fail the run.  Instead, their\n")
+	fmt.Fprintf(out, "'_pkg' rules print the errors and fail, so only the targets which depend on them fail.\n")
+	fmt.Fprintf(out, "The errors are still reported, but the exit code is 0.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "When --errors-format=json is specified, errors are reported as a JSON object with a list\n")
+	fmt.Fprintf(out, "of \"errors\", each with kind (list, parse, type, unknown, load, output or other), pkgPath,\n")
+	fmt.Fprintf(out, "file, line, column and msg, as available.  With --errors-file, errors are written to that\n")
+	fmt.Fprintf(out, "file instead of stderr, and it is written even if there are no errors.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "Exit codes are 1 for bad flags, 2 if packages could not be loaded, 3 if packages have\n")
+	fmt.Fprintf(out, "errors (see --ignore-errors), and 4 if the output could not be generated or written.\n")
+	fmt.Fprintf(out, "\n")
 	fmt.Fprintf(out, "To make this easier to use, the variables GO2MAKE_BY_PKG and GO2MAKE_BY_PATH are defined.\n")
 	fmt.Fprintf(out, "These can be used via make's '$(call)' function.\n")
 	fmt.Fprintf(out, " Flags:\n")
 
 	pflag.PrintDefaults()
 }
-
-func absOrExit(path string) string {
-	abs, err := filepath.Abs(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v", err)
-		os.Exit(1)
-	}
-	return abs
-}
-
-func dropTrailingSlash(s string) string {
-	return strings.TrimRight(s, "/")
-}
-
-func forEach(in []string, fn func(s string) string) []string {
-	out := make([]string, 0, len(in))
-	for _, s := range in {
-		out = append(out, fn(s))
-	}
-	return out
-}
-
-func (emit emitter) loadPackages(targets ...string) ([]*packages.Package, error) {
-	cfg := packages.Config{
-		Mode:       packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedModule,
-		Tests:      false,
-		BuildFlags: []string{"-tags", strings.Join(emit.tags, ",")},
-	}
-	if emit.imports {
-		cfg.Mode |= packages.NeedDeps
-	}
-	return packages.Load(&cfg, targets...)
-}
-
-func (emit emitter) visitPackages(pkgs []*packages.Package) map[string]*packages.Package {
-	pkgMap := map[string]*packages.Package{}
-	errs := false
-	for _, p := range pkgs {
-		ok := emit.visitPackage(p, pkgMap)
-		if !ok {
-			errs = true
-		}
-	}
-	if errs {
-		return nil
-	}
-	return pkgMap
-}
-
-func (emit emitter) visitPackage(pkg *packages.Package, pkgMap map[string]*packages.Package) bool {
-	debug("visiting package", pkg.PkgPath)
-	if pkgMap[pkg.PkgPath] == pkg {
-		debug("  ", pkg.PkgPath, "was already visited")
-		return true
-	}
-
-	if len(emit.roots) > 0 && !rooted(pkg.PkgPath, emit.roots) {
-		debug("  ", pkg.PkgPath, "is not under an allowed root")
-		return true
-	}
-
-	if len(emit.prune) > 0 && rooted(pkg.PkgPath, emit.prune) {
-		debug("  ", pkg.PkgPath, "pruned")
-		return true
-	}
-
-	debug("  ", pkg.PkgPath, "is new")
-	pkgMap[pkg.PkgPath] = pkg
-
-	ok := true
-	for _, e := range pkg.Errors {
-		if emit.ignoreErrors {
-			debug("    ignoring error:", e.Msg)
-		} else {
-			fmt.Fprintf(os.Stderr, "%s\n", e.Msg)
-			ok = false
-		}
-	}
-
-	// Don't recurse if we have errors already.
-	if ok && emit.imports && len(pkg.Imports) > 0 {
-		debug("  ", pkg.PkgPath, "has", len(pkg.Imports), "imports")
-
-		visitEach(pkg.Imports, func(imp *packages.Package) {
-			if !emit.visitPackage(imp, pkgMap) {
-				ok = false
-			}
-		})
-	}
-
-	return ok
-}
-
-func rooted(pkg string, list []string) bool {
-	for _, s := range list {
-		if pkg == s || strings.HasPrefix(pkg, s+"/") {
-			return true
-		}
-	}
-	return false
-}
-
-func visitEach(all map[string]*packages.Package, fn func(pkg *packages.Package)) {
-	for _, k := range keys(all) {
-		fn(all[k])
-	}
-}
-
-func keys(m map[string]*packages.Package) []string {
-	sl := make([]string, 0, len(m))
-	for k := range m {
-		sl = append(sl, k)
-	}
-	sort.Strings(sl)
-	return sl
-}
-
-func maybeRelative(path, relativeTo string) (string, bool) {
-	if path == relativeTo || strings.HasPrefix(path, relativeTo+"/") {
-		return "." + strings.TrimPrefix(path, relativeTo), true
-	}
-	return path, false
-}
-
-func (emit emitter) emitMake(out io.Writer, pkgMap map[string]*packages.Package) {
-	// Emit helpful macros for callers.
-	fmt.Fprintf(out, "# This file is autogenerated.\n")
-	fmt.Fprintf(out, "\n")
-	fmt.Fprintf(out, "# This variable may be used with $(call). It takes a single argument\n")
-	fmt.Fprintf(out, "# which is the Go package name, e.g. \"example.com/pkg\".\n")
-	fmt.Fprintf(out, "GO2MAKE_BY_PKG = %s/by-pkg/$(1)/_pkg\n", emit.stateDir)
-	fmt.Fprintf(out, "\n")
-	fmt.Fprintf(out, "# This variable may be used with $(call). It takes a single argument\n")
-	fmt.Fprintf(out, "# which is the local package path, e.g. \"path/pkg\" or \"./path/pkg\".\n")
-	fmt.Fprintf(out, "GO2MAKE_BY_PATH = %s/by-path/./$(patsubst ./%%,%%,$(1))/_pkg\n", emit.stateDir)
-	fmt.Fprintf(out, "\n")
-
-	// Emit rules for each package.
-	visitEach(pkgMap, func(pkg *packages.Package) {
-
-		codeDir := ""
-		isRel := false
-		if len(pkg.GoFiles) > 0 {
-			codeDir, isRel = maybeRelative(filepath.Dir(pkg.GoFiles[0]), emit.relPath)
-			// Emit a rule to represent changes to the directory contents.
-			// This rule will be evaluated whenever the code-directory is
-			// newer than the saved file-list, but the file-list will only get
-			// touched (triggering downstream rebuilds) if the set of files
-			// actually changes.
-			fmt.Fprintf(out, "%s/by-pkg/%s/_files: %s/\n", emit.stateDir, pkg.PkgPath, codeDir)
-			fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
-			fmt.Fprintf(out, "\t@ls $</*.go | LC_ALL=C sort > $@.tmp\n")
-			fmt.Fprintf(out, "\t@if ! cmp -s $@.tmp $@; then \\\n")
-			fmt.Fprintf(out, "\t    cat $@.tmp > $@; \\\n")
-			fmt.Fprintf(out, "\tfi\n")
-			fmt.Fprintf(out, "\t@rm -f $@.tmp\n")
-			fmt.Fprintf(out, "\n")
-		}
-
-		// Emit a rule to represent the whole package.  This uses a file,
-		// rather than the directory itself, to avoid nested dir creation
-		// changing the directory's timestamp.
-		fmt.Fprintf(out, "%s/by-pkg/%s/_pkg:", emit.stateDir, pkg.PkgPath)
-		if len(pkg.GoFiles) > 0 {
-			fmt.Fprintf(out, " %s/by-pkg/%s/_files", emit.stateDir, pkg.PkgPath)
-		}
-		for _, f := range pkg.GoFiles {
-			rel, _ := maybeRelative(f, emit.relPath)
-			fmt.Fprintf(out, " \\\n  %s", rel)
-		}
-		for _, imp := range keys(pkg.Imports) {
-			if pkgMap[pkg.Imports[imp].PkgPath] != nil {
-				fmt.Fprintf(out, " \\\n  %s/by-pkg/%s/_pkg", emit.stateDir, pkg.Imports[imp].PkgPath)
-			}
-		}
-		fmt.Fprintf(out, "\n")
-		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
-		fmt.Fprintf(out, "\t@touch $@\n")
-		fmt.Fprintf(out, "\n")
-
-		if isRel {
-			// Emit a rule to represent the package, but by a relative path.  This
-			// is useful when you know the path to something but maybe not which Go
-			// package it is (e.g. you have a bunch of packages).  Like the by-pkg
-			// equivalent, this uses a file, to avoid nested dir creation changing
-			// the directory's timestamp.
-			fmt.Fprintf(out, "%s/by-path/%s/_pkg: %s/by-pkg/%s/_pkg\n", emit.stateDir, codeDir, emit.stateDir, pkg.PkgPath)
-			fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
-			fmt.Fprintf(out, "\t@touch $@\n")
-			fmt.Fprintf(out, "\n")
-		}
-	})
-}
-
-func (emit emitter) emitJSON(out io.Writer, pkgMap map[string]*packages.Package) {
-	jb, err := json.Marshal(pkgMap)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "JSON error: %v", err)
-		os.Exit(1)
-	}
-	fmt.Fprintln(out, string(jb))
-}
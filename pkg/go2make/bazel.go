@@ -0,0 +1,305 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	// bazelFile is the name of the BUILD files which are written.
+	bazelFile = "BUILD.bazel"
+
+	// bazelHeader marks BUILD files which go2make owns.
+	bazelHeader = "# This file is autogenerated by go2make."
+
+	// bazelKeepBegin and bazelKeepEnd surround hand-written sections of
+	// BUILD files, which are preserved when the file is regenerated.
+	bazelKeepBegin = "# go2make:keep-begin"
+	bazelKeepEnd   = "# go2make:keep-end"
+)
+
+// emitBazel writes a BUILD file for each package in the main module(s), and
+// emits the names of the files which changed.
+func (emit emitter) emitBazel(out io.Writer, pkgMap map[string]*packages.Package) error {
+	for _, k := range keys(pkgMap) {
+		pkg := pkgMap[k]
+		if isTestNode(pkg) || pkg.Module == nil || !pkg.Module.Main || len(pkg.GoFiles) == 0 {
+			continue
+		}
+		dir := filepath.Dir(pkg.GoFiles[0])
+		if _, isRel := maybeRelative(dir, emit.relPath); !isRel {
+			emit.debug("  ", pkg.PkgPath, "is not under", emit.relPath, "- skipping BUILD file")
+			continue
+		}
+		filename := filepath.Join(dir, bazelFile)
+
+		old, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(old) > 0 && !bytes.HasPrefix(old, []byte(bazelHeader)) {
+			emit.warn("%s was not written by go2make, skipping", filename)
+			continue
+		}
+		content := emit.bazelBuildFile(pkg, pkgMap) + bazelKeepSections(string(old))
+		if content == string(old) {
+			continue
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			return err
+		}
+		rel, _ := maybeRelative(filename, emit.relPath)
+		fmt.Fprintln(out, rel)
+	}
+	return nil
+}
+
+// bazelKeepSections returns the hand-written sections of an existing BUILD
+// file, including their markers.
+func bazelKeepSections(old string) string {
+	keep := []string{}
+	inKeep := false
+	for _, line := range strings.SplitAfter(old, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == bazelKeepBegin {
+			inKeep = true
+		}
+		if inKeep {
+			keep = append(keep, strings.TrimSuffix(line, "\n")+"\n")
+		}
+		if trimmed == bazelKeepEnd {
+			inKeep = false
+			keep = append(keep, "\n")
+		}
+	}
+	if inKeep {
+		// Unterminated, so close it rather than lose it.
+		keep = append(keep, bazelKeepEnd+"\n", "\n")
+	}
+	if len(keep) == 0 {
+		return ""
+	}
+	return "\n" + strings.TrimSuffix(strings.Join(keep, ""), "\n")
+}
+
+// bazelBuildFile returns the generated part of the BUILD file for pkg.
+func (emit emitter) bazelBuildFile(pkg *packages.Package, pkgMap map[string]*packages.Package) string {
+	dir := filepath.Dir(pkg.GoFiles[0])
+	name := bazelName(pkg)
+	cgo := len(pkg.CompiledGoFiles) != len(pkg.GoFiles)
+
+	srcs := []string{}
+	for _, f := range append(append([]string{}, pkg.GoFiles...), pkg.OtherFiles...) {
+		srcs = append(srcs, bazelRel(dir, f))
+	}
+	embeds := []string{}
+	for _, f := range pkg.EmbedFiles {
+		embeds = append(embeds, bazelRel(dir, f))
+	}
+	deps := []string{}
+	for _, imp := range pkg.Imports {
+		if label := emit.bazelLabel(imp); label != "" {
+			deps = append(deps, label)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s  Hand-written rules may be\n", bazelHeader)
+	fmt.Fprintf(buf, "# added between %q and\n", bazelKeepBegin)
+	fmt.Fprintf(buf, "# %q lines, and will be preserved.\n", bazelKeepEnd)
+	fmt.Fprintf(buf, "\n")
+	rules := []string{"go_library"}
+	kind := "go_library"
+	if pkg.Name == "main" {
+		rules = []string{"go_binary"}
+		kind = "go_binary"
+	}
+
+	var test *bazelTest
+	if emit.tests {
+		test = emit.bazelTestFor(pkg, pkgMap)
+		if test != nil {
+			rules = append(rules, "go_test")
+		}
+	}
+	loads := []string{}
+	for _, r := range rules {
+		loads = append(loads, fmt.Sprintf("%q", r))
+	}
+	fmt.Fprintf(buf, "load(\"@io_bazel_rules_go//go:def.bzl\", %s)\n", strings.Join(loads, ", "))
+	fmt.Fprintf(buf, "\n")
+
+	fmt.Fprintf(buf, "%s(\n", kind)
+	fmt.Fprintf(buf, "    name = %q,\n", name)
+	bazelList(buf, "srcs", srcs)
+	if cgo {
+		fmt.Fprintf(buf, "    cgo = True,\n")
+	}
+	bazelList(buf, "embedsrcs", embeds)
+	if kind == "go_library" {
+		fmt.Fprintf(buf, "    importpath = %q,\n", pkg.PkgPath)
+	}
+	fmt.Fprintf(buf, "    visibility = [\"//visibility:public\"],\n")
+	bazelList(buf, "deps", deps)
+	fmt.Fprintf(buf, ")\n")
+
+	if test != nil {
+		fmt.Fprintf(buf, "\n")
+		fmt.Fprintf(buf, "go_test(\n")
+		fmt.Fprintf(buf, "    name = %q,\n", name+"_test")
+		srcs := []string{}
+		for _, f := range test.srcs {
+			srcs = append(srcs, bazelRel(dir, f))
+		}
+		bazelList(buf, "srcs", srcs)
+		if test.embed {
+			fmt.Fprintf(buf, "    embed = [%q],\n", ":"+name)
+		}
+		bazelList(buf, "deps", test.deps)
+		fmt.Fprintf(buf, ")\n")
+	}
+	return buf.String()
+}
+
+// bazelTest describes the go_test target for a package.
+type bazelTest struct {
+	srcs  []string
+	embed bool
+	deps  []string
+}
+
+// bazelTestFor returns the go_test for pkg, or nil if it has no tests.
+func (emit emitter) bazelTestFor(pkg *packages.Package, pkgMap map[string]*packages.Package) *bazelTest {
+	internal, external := testVariants(pkg, pkgMap)
+	if internal == nil && external == nil {
+		return nil
+	}
+	test := &bazelTest{embed: internal != nil}
+	inPkg := map[string]bool{}
+	for _, f := range pkg.GoFiles {
+		inPkg[f] = true
+	}
+	for _, v := range []*packages.Package{internal, external} {
+		if v == nil {
+			continue
+		}
+		for _, f := range v.GoFiles {
+			if !inPkg[f] {
+				inPkg[f] = true
+				test.srcs = append(test.srcs, f)
+			}
+		}
+		for _, imp := range v.Imports {
+			if _, found := pkg.Imports[imp.PkgPath]; test.embed && (found || imp.PkgPath == pkg.PkgPath) {
+				continue // provided by embed
+			}
+			if label := emit.bazelLabel(imp); label != "" {
+				test.deps = append(test.deps, label)
+			}
+		}
+	}
+	return test
+}
+
+// bazelList emits a sorted, de-duplicated list attribute, if it is not
+// empty.
+func bazelList(out io.Writer, attr string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	sort.Strings(items)
+	fmt.Fprintf(out, "    %s = [\n", attr)
+	last := ""
+	for _, item := range items {
+		if item != last {
+			fmt.Fprintf(out, "        %q,\n", item)
+		}
+		last = item
+	}
+	fmt.Fprintf(out, "    ],\n")
+}
+
+// bazelName returns the name of the target for pkg, which is the last
+// element of the package path (or the binary name, for main packages).
+func bazelName(pkg *packages.Package) string {
+	if pkg.Name == "main" {
+		return binName(pkg.PkgPath)
+	}
+	return path.Base(pkg.PkgPath)
+}
+
+// bazelLabel returns the Bazel label for an imported package, or "" if it
+// does not need one (i.e. it is in the standard library).
+func (emit emitter) bazelLabel(pkg *packages.Package) string {
+	if pkg.Module == nil {
+		return ""
+	}
+	name := bazelName(pkg)
+	if pkg.Module.Main && len(pkg.GoFiles) > 0 {
+		if rel, isRel := maybeRelative(filepath.Dir(pkg.GoFiles[0]), emit.relPath); isRel {
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, "."), "/")
+			if rel == "" || path.Base(rel) != name {
+				return fmt.Sprintf("//%s:%s", rel, name)
+			}
+			return "//" + rel
+		}
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(pkg.PkgPath, pkg.Module.Path), "/")
+	if rel == "" || path.Base(rel) != name {
+		return fmt.Sprintf("@%s//%s:%s", bazelRepoName(pkg.Module.Path), rel, name)
+	}
+	return fmt.Sprintf("@%s//%s", bazelRepoName(pkg.Module.Path), rel)
+}
+
+// bazelRepoName returns the conventional name of the external repository
+// for a module, e.g. "github.com/foo/bar" is "com_github_foo_bar".
+func bazelRepoName(modPath string) string {
+	parts := strings.Split(modPath, "/")
+	host := strings.Split(parts[0], ".")
+	for i, j := 0, len(host)-1; i < j; i, j = i+1, j-1 {
+		host[i], host[j] = host[j], host[i]
+	}
+	name := strings.Join(append(host, parts[1:]...), "_")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+// bazelRel returns the path of f relative to dir, for use in srcs.
+func bazelRel(dir, f string) string {
+	if rel, err := filepath.Rel(dir, f); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return f
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// This file implements the (experimental) compile output, in which make
+// drives the Go compiler and linker directly, one package at a time.
+//
+// Packages in the main module(s) are compiled into archives in the state
+// dir.  Everything else (the standard library and other modules) is
+// compiled by `go list -export` when go2make runs, and the resulting
+// archives in the Go build cache are used as-is.
+
+// compilable returns the set of packages in pkgMap which can be compiled
+// by make.  This is limited to pure Go packages in the main module(s) whose
+// main-module imports are also compilable.  Packages with cgo, assembly or
+// embedded files need more than `go tool compile`, and are left to `go
+// build`, as are packages with errors which were not ignored.
+func (emit emitter) compilable(pkgMap map[string]*packages.Package) map[string]bool {
+	memo := map[string]bool{}
+	var check func(pkg *packages.Package) bool
+	check = func(pkg *packages.Package) bool {
+		if v, found := memo[pkg.PkgPath]; found {
+			return v
+		}
+		memo[pkg.PkgPath] = false // break cycles
+		if pkg.Module == nil || !pkg.Module.Main || len(pkg.GoFiles) == 0 {
+			return false
+		}
+		if len(emit.brokenErrors(pkg)) > 0 {
+			emit.debug("  ", pkg.PkgPath, "has errors, can't compile")
+			return false
+		}
+		if len(pkg.OtherFiles) > 0 || len(pkg.EmbedFiles) > 0 || len(pkg.CompiledGoFiles) != len(pkg.GoFiles) {
+			emit.debug("  ", pkg.PkgPath, "is not pure Go, can't compile")
+			return false
+		}
+		for _, imp := range pkg.Imports {
+			if imp.Module != nil && imp.Module.Main {
+				if pkgMap[imp.PkgPath] == nil || !check(imp) {
+					emit.debug("  ", pkg.PkgPath, "imports", imp.PkgPath, "which can't be compiled")
+					return false
+				}
+			} else if imp.ExportFile == "" && imp.PkgPath != "unsafe" {
+				emit.debug("  ", pkg.PkgPath, "imports", imp.PkgPath, "which has no export file")
+				return false
+			}
+		}
+		memo[pkg.PkgPath] = true
+		return true
+	}
+
+	out := map[string]bool{}
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if !isTestNode(pkg) && check(pkg) {
+			out[pkg.PkgPath] = true
+		}
+	})
+	return out
+}
+
+// archive returns the path to the compiled archive for pkg.
+func (emit emitter) archive(pkg *packages.Package, compiled map[string]bool) string {
+	if compiled[pkg.PkgPath] {
+		return fmt.Sprintf("%s/by-pkg/%s/_pkg.a", emit.stateDir, pkg.PkgPath)
+	}
+	return pkg.ExportFile
+}
+
+// emitMakeCompile emits rules to compile each compilable package in pkgMap
+// into an archive, and to link each main package into a binary.  Main
+// packages which can't be compiled this way are built by `go build`.
+func (emit emitter) emitMakeCompile(out io.Writer, pkgMap map[string]*packages.Package) {
+	compiled := emit.compilable(pkgMap)
+	mains := emit.mainsByName(pkgMap)
+
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if !compiled[pkg.PkgPath] {
+			return
+		}
+		pkgDir := fmt.Sprintf("%s/by-pkg/%s", emit.stateDir, pkg.PkgPath)
+
+		// Emit a rule for the importcfg, which maps each import to its
+		// archive.  The contents can only change when the package does.
+		lines := []string{}
+		prereqs := []string{pkgDir + "/_pkg", pkgDir + "/_importcfg"}
+		for _, path := range keys(pkg.Imports) {
+			imp := pkg.Imports[path]
+			if imp.PkgPath == "unsafe" {
+				continue
+			}
+			if path != imp.PkgPath {
+				// e.g. vendored packages
+				lines = append(lines, fmt.Sprintf("importmap %s=%s", path, imp.PkgPath))
+			}
+			lines = append(lines, fmt.Sprintf("packagefile %s=%s", imp.PkgPath, emit.archive(imp, compiled)))
+			if compiled[imp.PkgPath] {
+				prereqs = append(prereqs, emit.archive(imp, compiled))
+			}
+		}
+		emitImportcfg(out, pkgDir+"/_importcfg", pkgDir+"/_pkg", lines)
+
+		// Emit a rule to compile the package.
+		emitPrereqs(out, pkgDir+"/_pkg.a", prereqs)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		pkgName := pkg.PkgPath
+		if pkg.Name == "main" {
+			pkgName = "main"
+		}
+		args := []string{"-o", "$@", "-p", pkgName, "-pack", "-complete"}
+		if lang := goLang(pkg.Module); lang != "" {
+			args = append(args, "-lang="+lang)
+		}
+		args = append(args, "-importcfg", pkgDir+"/_importcfg")
+		for _, f := range pkg.GoFiles {
+			rel, _ := maybeRelative(f, emit.relPath)
+			args = append(args, rel)
+		}
+		fmt.Fprintf(out, "\t%s$(GO2MAKE_GO) tool compile %s\n", emit.platformEnv(), strings.Join(args, " "))
+		fmt.Fprintf(out, "\n")
+
+		if mains[binName(pkg.PkgPath)] == pkg {
+			emit.emitMakeLink(out, pkg, compiled)
+		}
+	})
+
+	emit.emitMakeBinaries(out, pkgMap, mains, compiled)
+}
+
+// emitMakeLink emits rules to link a main package into a binary.
+func (emit emitter) emitMakeLink(out io.Writer, pkg *packages.Package, compiled map[string]bool) {
+	pkgDir := fmt.Sprintf("%s/by-pkg/%s", emit.stateDir, pkg.PkgPath)
+
+	// The linker needs every package in the binary, including the runtime,
+	// which is not always imported.
+	deps := map[string]*packages.Package{}
+	var walk func(p *packages.Package)
+	walk = func(p *packages.Package) {
+		for _, imp := range p.Imports {
+			if deps[imp.PkgPath] == nil && imp.PkgPath != "unsafe" {
+				deps[imp.PkgPath] = imp
+				walk(imp)
+			}
+		}
+	}
+	walk(pkg)
+	if rt := emit.runtime; rt != nil && deps[rt.PkgPath] == nil {
+		deps[rt.PkgPath] = rt
+		walk(rt)
+	}
+	lines := []string{}
+	for _, path := range keys(deps) {
+		lines = append(lines, fmt.Sprintf("packagefile %s=%s", path, emit.archive(deps[path], compiled)))
+	}
+	emitImportcfg(out, pkgDir+"/_importcfg.link", pkgDir+"/_pkg", lines)
+
+	bin := emit.binDir() + "/" + binName(pkg.PkgPath)
+	fmt.Fprintf(out, "GO2MAKE_BINARIES += %s\n", bin)
+	fmt.Fprintf(out, "%s: %s/_pkg.a %s/_importcfg.link\n", bin, pkgDir, pkgDir)
+	fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+	fmt.Fprintf(out, "\t%s$(GO2MAKE_GO) tool link -o $@ -importcfg %s/_importcfg.link -buildmode=exe $(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_%s) %s/_pkg.a\n",
+		emit.platformEnv(), pkgDir, binName(pkg.PkgPath), pkgDir)
+	fmt.Fprintf(out, "\n")
+}
+
+// emitImportcfg emits a rule to write an importcfg file.
+func emitImportcfg(out io.Writer, target, prereq string, lines []string) {
+	sort.Strings(lines)
+	fmt.Fprintf(out, "%s: %s\n", target, prereq)
+	fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+	fmt.Fprintf(out, "\t@printf '%%s\\n' \\\n")
+	for _, line := range lines {
+		fmt.Fprintf(out, "\t    '%s' \\\n", line)
+	}
+	fmt.Fprintf(out, "\t    > $@\n")
+	fmt.Fprintf(out, "\n")
+}
+
+// goLang returns the language version for the compiler's -lang flag, e.g.
+// "go1.19", from a module's go directive.
+func goLang(mod *packages.Module) string {
+	if mod == nil || mod.GoVersion == "" {
+		return ""
+	}
+	parts := strings.SplitN(mod.GoVersion, ".", 3)
+	if len(parts) < 2 {
+		return "go" + mod.GoVersion
+	}
+	return "go" + parts[0] + "." + parts[1]
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Emitter writes a Graph in some format.
+type Emitter interface {
+	Emit(out io.Writer, g *Graph) error
+}
+
+// EmitterFunc is an adapter which allows an ordinary function to be used as
+// an Emitter.
+type EmitterFunc func(out io.Writer, g *Graph) error
+
+// Emit calls fn(out, g).
+func (fn EmitterFunc) Emit(out io.Writer, g *Graph) error {
+	return fn(out, g)
+}
+
+// formats are the built-in Emitters, by name.
+var formats = map[string]Emitter{
+	"make":      EmitterFunc(emitMakeGraph),
+	"compile":   EmitterFunc(emitCompileGraph),
+	"ninja":     EmitterFunc(emitNinjaGraph),
+	"bazel":     singleVariant(emitter.emitBazel),
+	"dot":       singleVariant(noError(emitter.emitDot)),
+	"mermaid":   singleVariant(noError(emitter.emitMermaid)),
+	"graphml":   singleVariant(noError(emitter.emitGraphML)),
+	"cyclonedx": eachVariant(needDeps(emitter.emitCycloneDX)),
+	"spdx":      eachVariant(needDeps(emitter.emitSPDX)),
+	"json":      EmitterFunc(emitJSONGraph),
+	"ndjson":    eachVariant(emitter.emitNDJSON),
+	"json-raw":  EmitterFunc(emitJSONRawGraph),
+}
+
+// Formats returns the names of the built-in output formats, sorted.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEmitter returns the built-in Emitter for the named format.
+func NewEmitter(format string) (Emitter, error) {
+	if e, found := formats[format]; found {
+		return namedEmitter{format: format, emitter: e}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// SupportsVariants returns false if the named format can only be used
+// without Platforms and TagSets.
+func SupportsVariants(format string) bool {
+	switch format {
+	case "bazel", "dot", "mermaid", "graphml":
+		return false
+	}
+	return true
+}
+
+// NewTemplateEmitter returns an Emitter which executes the named Go
+// text/template file once for each platform and tag set.
+func NewTemplateEmitter(filename string) (Emitter, error) {
+	tmpl, err := emitter{}.loadTemplate(filename)
+	if err != nil {
+		return nil, err
+	}
+	e := eachVariant(func(emit emitter, out io.Writer, pkgMap map[string]*packages.Package) error {
+		return emit.emitTemplate(out, tmpl, pkgMap)
+	})
+	return namedEmitter{format: "template", emitter: e}, nil
+}
+
+// variantFunc emits the packages of a single platform and tag set.
+type variantFunc func(emit emitter, out io.Writer, pkgMap map[string]*packages.Package) error
+
+// eachVariant returns an Emitter which calls fn for each variant in turn.
+func eachVariant(fn variantFunc) Emitter {
+	return EmitterFunc(func(out io.Writer, g *Graph) error {
+		for i, v := range g.variants {
+			if err := fn(v, out, g.pkgMaps[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// singleVariant returns an Emitter for formats which do not support
+// platforms or tag sets.
+func singleVariant(fn variantFunc) Emitter {
+	return EmitterFunc(func(out io.Writer, g *Graph) error {
+		if g.multi {
+			return fmt.Errorf("this format does not support platforms or tag sets")
+		}
+		return fn(g.emit, out, g.pkgMaps[0])
+	})
+}
+
+// noError adapts emitters which can't fail.
+func noError(fn func(emit emitter, out io.Writer, pkgMap map[string]*packages.Package)) variantFunc {
+	return func(emit emitter, out io.Writer, pkgMap map[string]*packages.Package) error {
+		fn(emit, out, pkgMap)
+		return nil
+	}
+}
+
+// needDeps guards emitters which need every dependency to have been loaded.
+func needDeps(fn variantFunc) variantFunc {
+	return func(emit emitter, out io.Writer, pkgMap map[string]*packages.Package) error {
+		if !emit.deps && !emit.imports {
+			return fmt.Errorf("this format needs Options.Deps or Options.Imports")
+		}
+		return fn(emit, out, pkgMap)
+	}
+}
+
+func emitMakeGraph(out io.Writer, g *Graph) error {
+	if g.multi {
+		g.emit.emitMakeVariants(out, g.variants, g.pkgMaps)
+	} else {
+		g.emit.emitMake(out, g.pkgMaps[0])
+	}
+	return nil
+}
+
+func emitCompileGraph(out io.Writer, g *Graph) error {
+	if !g.emit.compile {
+		return fmt.Errorf("the compile format needs Options.Compile")
+	}
+	return emitMakeGraph(out, g)
+}
+
+func emitNinjaGraph(out io.Writer, g *Graph) error {
+	if g.multi {
+		g.emit.emitNinjaVariants(out, g.variants, g.pkgMaps)
+	} else {
+		g.emit.emitNinja(out, g.pkgMaps[0])
+	}
+	return nil
+}
+
+func emitJSONGraph(out io.Writer, g *Graph) error {
+	if g.multi {
+		return g.emit.emitJSONVariants(out, g.variants, g.pkgMaps)
+	}
+	return g.emit.emitJSON(out, g.pkgMaps[0])
+}
+
+func emitJSONRawGraph(out io.Writer, g *Graph) error {
+	if g.multi {
+		return g.emit.emitJSONRawVariants(out, g.variants, g.pkgMaps)
+	}
+	return g.emit.emitJSONRaw(out, g.pkgMaps[0])
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// LoadError is returned by Load when packages could not be loaded at all,
+// e.g. because `go list` failed.
+type LoadError struct {
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("loading packages: %v", e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// PackageError is a problem with a single package, such as a syntax error or
+// a missing import.
+type PackageError struct {
+	PkgPath string
+	Pos     string // "file:line:col", or "" if unknown
+	File    string // parsed from Pos
+	Line    int    // parsed from Pos, or 0 if unknown
+	Column  int    // parsed from Pos, or 0 if unknown
+	Msg     string
+	Kind    packages.ErrorKind
+}
+
+func (e *PackageError) Error() string {
+	if e.Pos == "" {
+		return e.Msg
+	}
+	return e.Pos + ": " + e.Msg
+}
+
+// newPackageError converts a go/packages error.
+func newPackageError(pkg *packages.Package, e packages.Error) *PackageError {
+	pe := &PackageError{PkgPath: pkg.PkgPath, Pos: e.Pos, Msg: e.Msg, Kind: e.Kind}
+	if pe.Pos == "-" {
+		pe.Pos = ""
+	}
+	pe.File, pe.Line, pe.Column = parsePos(pe.Pos)
+	return pe
+}
+
+// parsePos splits a position like "file:line:col" or "file:line".
+func parsePos(pos string) (file string, line, col int) {
+	file = pos
+	nums := []int{}
+	for len(nums) < 2 {
+		i := strings.LastIndex(file, ":")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(file[i+1:])
+		if err != nil {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		file = file[:i]
+	}
+	switch len(nums) {
+	case 1:
+		line = nums[0]
+	case 2:
+		line, col = nums[0], nums[1]
+	}
+	return file, line, col
+}
+
+// kindName returns a short name for a go/packages error kind.
+func kindName(kind packages.ErrorKind) string {
+	switch kind {
+	case packages.ListError:
+		return "list"
+	case packages.ParseError:
+		return "parse"
+	case packages.TypeError:
+		return "type"
+	}
+	return "unknown"
+}
+
+// PackageErrors is returned by Load when packages have errors, and errors
+// are not ignored.
+type PackageErrors []*PackageError
+
+// dedup removes errors which are the same in every way, e.g. when a package
+// is loaded for several platforms.
+func (errs PackageErrors) dedup() PackageErrors {
+	seen := map[PackageError]bool{}
+	result := PackageErrors{}
+	for _, e := range errs {
+		if !seen[*e] {
+			seen[*e] = true
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (errs PackageErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// EmitError is returned by the built-in Emitters when output could not be
+// generated or written.
+type EmitError struct {
+	Format string
+	Err    error
+}
+
+func (e *EmitError) Error() string {
+	return fmt.Sprintf("emitting %s: %v", e.Format, e.Err)
+}
+
+func (e *EmitError) Unwrap() error {
+	return e.Err
+}
+
+// jsonErrors is the JSON form of WriteErrorsJSON.
+type jsonErrors struct {
+	Errors []jsonError `json:"errors"`
+}
+
+// jsonError is a single error.  Kind is one of "list", "parse", "type" or
+// "unknown" for package errors, "load" for LoadErrors, "output" for
+// EmitErrors, or "other".
+type jsonError struct {
+	Kind    string `json:"kind"`
+	PkgPath string `json:"pkgPath,omitempty"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Msg     string `json:"msg"`
+	Ignored bool   `json:"ignored,omitempty"`
+}
+
+func newJSONError(pe *PackageError, ignored bool) jsonError {
+	return jsonError{
+		Kind:    kindName(pe.Kind),
+		PkgPath: pe.PkgPath,
+		File:    pe.File,
+		Line:    pe.Line,
+		Column:  pe.Column,
+		Msg:     pe.Msg,
+		Ignored: ignored,
+	}
+}
+
+// WriteErrorsJSON writes err, which is usually from Load or an Emitter, and
+// the errors which were ignored (see Graph.IgnoredErrors) as a JSON object
+// with a list of "errors".  Each PackageError is listed separately, with its
+// location.  Either may be nil.
+func WriteErrorsJSON(out io.Writer, err error, ignored PackageErrors) error {
+	result := jsonErrors{Errors: []jsonError{}}
+	var perrs PackageErrors
+	var lerr *LoadError
+	var eerr *EmitError
+	switch {
+	case err == nil:
+	case errors.As(err, &perrs):
+		for _, pe := range perrs {
+			result.Errors = append(result.Errors, newJSONError(pe, false))
+		}
+	case errors.As(err, &lerr):
+		result.Errors = append(result.Errors, jsonError{Kind: "load", Msg: lerr.Err.Error()})
+	case errors.As(err, &eerr):
+		result.Errors = append(result.Errors, jsonError{Kind: "output", Msg: eerr.Error()})
+	default:
+		result.Errors = append(result.Errors, jsonError{Kind: "other", Msg: err.Error()})
+	}
+	for _, pe := range ignored {
+		result.Errors = append(result.Errors, newJSONError(pe, true))
+	}
+	return emitJSONValue(out, result)
+}
+
+// errWriter remembers the first error from an io.Writer, so that the many
+// unchecked writes in the emitters can be checked once, at the end.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	ew.err = err
+	return n, err
+}
+
+// namedEmitter wraps a built-in Emitter, so its errors are EmitErrors.
+type namedEmitter struct {
+	format  string
+	emitter Emitter
+}
+
+func (ne namedEmitter) Emit(out io.Writer, g *Graph) error {
+	if g.emit.partial && ne.format != "make" && ne.format != "compile" {
+		return &EmitError{Format: ne.format, Err: fmt.Errorf("partial output is not supported")}
+	}
+	ew := &errWriter{w: out}
+	err := ne.emitter.Emit(ew, g)
+	if err == nil {
+		err = ew.err
+	}
+	if err != nil {
+		return &EmitError{Format: ne.format, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bufio"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// generateDirective is a single //go:generate line.
+type generateDirective struct {
+	file string   // the Go file in which the directive appears
+	args []string // the command and its arguments, unquoted
+}
+
+// goGenerates returns the //go:generate directives in pkg's GoFiles and
+// _test.go files, which go generate also runs.  Like cIncludes, this only
+// looks at packages in the main module(s), since generators in dependencies
+// are never run.
+func (emit emitter) goGenerates(pkg *packages.Package) []generateDirective {
+	if pkg.Module == nil || !pkg.Module.Main || len(pkg.GoFiles) == 0 {
+		return nil
+	}
+	dirs := []generateDirective{}
+	files := append(append([]string{}, pkg.GoFiles...), emit.testFiles(pkg)...)
+	for _, f := range files {
+		file, err := os.Open(f)
+		if err != nil {
+			emit.debug("    can't scan", f, "for go:generate:", err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "//go:generate ") && !strings.HasPrefix(line, "//go:generate\t") {
+				continue
+			}
+			args := splitGenerateArgs(line[len("//go:generate "):])
+			if len(args) > 0 {
+				dirs = append(dirs, generateDirective{file: f, args: args})
+			}
+		}
+		file.Close()
+	}
+	return dirs
+}
+
+// testFiles returns the _test.go files in pkg's dir which match the
+// emitter's platform and tags.  These are not in pkg unless tests were
+// loaded, and then only in its test variants.
+func (emit emitter) testFiles(pkg *packages.Package) []string {
+	dir := filepath.Dir(pkg.GoFiles[0])
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		emit.debug("    can't read", dir, "for test files:", err)
+		return nil
+	}
+	ctx := build.Default
+	if emit.goos != "" {
+		ctx.GOOS, ctx.GOARCH = emit.goos, emit.goarch
+	}
+	ctx.BuildTags = emit.tags
+	files := []string{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), "_test.go") {
+			continue
+		}
+		if ok, err := ctx.MatchFile(dir, e.Name()); err == nil && ok {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files
+}
+
+// splitGenerateArgs splits a go:generate command line into words.  Like go
+// generate, this splits on spaces and allows double-quoted Go strings.
+func splitGenerateArgs(line string) []string {
+	args := []string{}
+	line = strings.TrimSpace(line)
+	for line != "" {
+		if line[0] == '"' {
+			end := 1
+			for ; end < len(line); end++ {
+				if line[end] == '\\' {
+					end++
+				} else if line[end] == '"' {
+					break
+				}
+			}
+			if end >= len(line) {
+				return args // unterminated, go generate would fail
+			}
+			if s, err := strconv.Unquote(line[:end+1]); err == nil {
+				args = append(args, s)
+			}
+			line = strings.TrimLeft(line[end+1:], " \t")
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			i = len(line)
+		}
+		args = append(args, line[:i])
+		line = strings.TrimLeft(line[i:], " \t")
+	}
+	return args
+}
+
+// generateInputs returns the files which are named as arguments (either
+// alone or as the value of a --flag=value) to any of dirs, and which exist in
+// the package's module, plus the files which hold the directives themselves.
+func generateInputs(pkg *packages.Package, dirs []generateDirective) []string {
+	pkgDir := filepath.Dir(pkg.GoFiles[0])
+	root := filepath.Clean(pkg.Module.Dir)
+	found := map[string]bool{}
+	for _, d := range dirs {
+		found[d.file] = true
+		for _, arg := range d.args[1:] {
+			if _, val, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(arg, "-") {
+				arg = val
+			}
+			if arg == "" || strings.HasPrefix(arg, "-") || strings.Contains(arg, "$") {
+				continue
+			}
+			p := arg
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(pkgDir, p)
+			}
+			if !strings.HasPrefix(p, root+"/") {
+				continue
+			}
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				found[p] = true
+			}
+		}
+	}
+	out := make([]string, 0, len(found))
+	for f := range found {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// generateTools returns the packages in pkgMap which are run as generators
+// by dirs, via `go run <pkg>`.
+func generateTools(pkg *packages.Package, dirs []generateDirective, pkgMap map[string]*packages.Package) []string {
+	pkgDir := filepath.Dir(pkg.GoFiles[0])
+	byDir := map[string]string{}
+	for _, p := range pkgMap {
+		if len(p.GoFiles) > 0 && !isTestNode(p) {
+			byDir[filepath.Dir(p.GoFiles[0])] = p.PkgPath
+		}
+	}
+	found := map[string]bool{}
+	for _, d := range dirs {
+		if len(d.args) < 3 || d.args[0] != "go" || d.args[1] != "run" {
+			continue
+		}
+		if arg := goRunPackage(d.args[2:]); arg != "" {
+			if strings.HasPrefix(arg, "./") || strings.HasPrefix(arg, "../") || arg == "." {
+				if path, ok := byDir[filepath.Join(pkgDir, arg)]; ok {
+					found[path] = true
+				}
+			} else if p := pkgMap[arg]; p != nil && !isTestNode(p) {
+				found[p.PkgPath] = true
+			}
+		}
+	}
+	out := make([]string, 0, len(found))
+	for path := range found {
+		out = append(out, path)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// goRunValueFlags are the `go run` flags which take a value.  If the value is
+// not given with "=", it is the next argument.
+var goRunValueFlags = map[string]bool{
+	"C": true, "asmflags": true, "buildmode": true, "compiler": true,
+	"coverpkg": true, "covermode": true, "exec": true, "gccgoflags": true,
+	"gcflags": true, "installsuffix": true, "ldflags": true, "mod": true,
+	"modfile": true, "overlay": true, "p": true, "pgo": true, "pkgdir": true,
+	"tags": true, "toolexec": true,
+}
+
+// goRunPackage returns the package argument of `go run`, given the
+// arguments after "run", or "" if there is none.  This is the first argument
+// which is not a flag or a flag's value.
+func goRunPackage(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+			return ""
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+		name := strings.TrimLeft(arg, "-")
+		if !strings.Contains(name, "=") && goRunValueFlags[name] {
+			i++ // skip the value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,1370 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package go2make calculates the dependencies of a set of Go packages, and
+// emits them as Makefile logic, or in one of several other formats.
+package go2make
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+type emitter struct {
+	roots            []string
+	prune            []string
+	tags             []string
+	ignoreErrors     bool
+	ignoreKinds      []string
+	ignoreIn         []string
+	owners           map[string]string              // file -> package path, for ignoreIn
+	includes         map[*packages.Package][]string // from cIncludes, when visited
+	partial          bool
+	relPath          string
+	imports          bool
+	stateDir         string
+	tests            bool
+	binaries         bool
+	compile          bool
+	runtime          *packages.Package // loaded with export data, if compile
+	graphColor       string
+	graphCollapseStd bool
+	goWork           string
+	modCache         string
+	deps             bool
+	stampMode        string
+	goos             string
+	goarch           string
+	tagSet           string
+	shared           map[string]bool
+	sharedDir        string
+	debugFn          func(items ...interface{})
+	warnFn           func(msg string)
+}
+
+func (emit emitter) debug(items ...interface{}) {
+	if emit.debugFn != nil {
+		emit.debugFn(items...)
+	}
+}
+
+func (emit emitter) warn(format string, args ...interface{}) {
+	if emit.warnFn != nil {
+		emit.warnFn(fmt.Sprintf(format, args...))
+	}
+}
+
+// Options control which packages are processed, and how they are emitted.
+// Start from DefaultOptions.
+type Options struct {
+	// Roots, if not empty, limits processing to packages under these
+	// prefixes.
+	Roots []string
+	// Prune lists package prefixes which are not processed.
+	Prune []string
+	// Tags are build tags to pass to Go.
+	Tags []string
+	// IgnoreErrors causes package errors to be ignored, rather than failing
+	// Load.
+	IgnoreErrors bool
+	// IgnoreErrorKinds causes package errors of these kinds to be ignored:
+	// "list", "parse", "type" or "unknown".
+	IgnoreErrorKinds []string
+	// IgnoreErrorsIn causes package errors in packages under these
+	// prefixes, or in their files (e.g. an import of a missing package), to
+	// be ignored.
+	IgnoreErrorsIn []string
+	// Partial causes packages with errors (which are not ignored) to be
+	// emitted as rules which print the errors and fail, rather than failing
+	// Load.  Only the make and compile formats support this.
+	Partial bool
+	// RelativeTo is the path under which by-path rules are emitted.
+	RelativeTo string
+	// Imports causes all imports of all packages to be processed,
+	// recursively.
+	Imports bool
+	// StateDir is the directory in which stamps are stored.
+	StateDir string
+	// Tests causes package tests to be processed.
+	Tests bool
+	// Binaries causes rules to build main packages to be emitted.
+	Binaries bool
+	// Compile causes the make format to drive the compiler and linker
+	// directly, rather than `go build` (experimental).  This loads export
+	// data for all dependencies.  Main packages which can't be compiled
+	// directly are still built by `go build`.
+	Compile bool
+	// Deps causes all dependencies to be loaded, even if Imports is false.
+	// The SBOM formats need this.  Modules are never downloaded, so they
+	// must already be in the module cache.
+	Deps bool
+	// Platforms are GOOS/GOARCH pairs to process, each in its own state
+	// dir.
+	Platforms []string
+	// TagSets are named sets of build tags to process, each in its own
+	// state dir, as "<name>:<tag>,<tag>".
+	TagSets []string
+	// GraphColor is which packages graph formats color: one of "none",
+	// "root" or "prune".
+	GraphColor string
+	// GraphCollapseStd causes graph formats to show the standard library as
+	// a single node.
+	GraphCollapseStd bool
+	// StampMode is how stamps decide they are out of date: one of "mtime"
+	// or "hash".
+	StampMode string
+	// Debug, if not nil, is called with debugging information.
+	Debug func(items ...interface{})
+	// Warn, if not nil, is called with warnings, e.g. about output which
+	// was skipped.
+	Warn func(msg string)
+}
+
+// DefaultOptions returns the options which match go2make's flag defaults.
+func DefaultOptions() Options {
+	return Options{
+		RelativeTo: ".",
+		StateDir:   ".go2make",
+		GraphColor: "none",
+		StampMode:  "mtime",
+	}
+}
+
+// Graph is the set of packages which were processed, once for each platform
+// and tag set.
+type Graph struct {
+	emit     emitter
+	variants []emitter
+	pkgMaps  []map[string]*packages.Package
+	// multi is true if platforms or tag sets were specified, even if
+	// there is just one variant.
+	multi   bool
+	ignored PackageErrors
+	broken  PackageErrors
+}
+
+// Variant is the set of packages for one platform and/or tag set.
+type Variant struct {
+	GOOS     string // "" for the default platform
+	GOARCH   string // "" for the default platform
+	TagSet   string // "" if there are no tag sets
+	Tags     []string
+	StateDir string
+	// Packages are keyed by package path, or by ID for test variants.
+	Packages map[string]*packages.Package
+}
+
+// Variants returns the processed packages for each platform and tag set.  If
+// neither Platforms nor TagSets were specified, there is exactly one.
+func (g *Graph) Variants() []Variant {
+	result := make([]Variant, 0, len(g.variants))
+	for i, v := range g.variants {
+		result = append(result, Variant{
+			GOOS:     v.goos,
+			GOARCH:   v.goarch,
+			TagSet:   v.tagSet,
+			Tags:     v.tags,
+			StateDir: v.stateDir,
+			Packages: g.pkgMaps[i],
+		})
+	}
+	return result
+}
+
+// Load loads the packages named by targets (e.g. "./..." or
+// "example.com/txt/color"), once for each platform and tag set, and visits
+// them and, if enabled, their imports.  If it returns PackageErrors, it also
+// returns a Graph which has only the IgnoredErrors.
+func Load(opts Options, targets ...string) (*Graph, error) {
+	switch opts.GraphColor {
+	case "none", "root", "prune":
+	default:
+		return nil, fmt.Errorf("unknown graph color mode %q", opts.GraphColor)
+	}
+	switch opts.StampMode {
+	case "mtime", "hash":
+	default:
+		return nil, fmt.Errorf("unknown stamp mode %q", opts.StampMode)
+	}
+	for _, kind := range opts.IgnoreErrorKinds {
+		switch kind {
+		case "list", "parse", "type", "unknown":
+		default:
+			return nil, fmt.Errorf("unknown error kind %q", kind)
+		}
+	}
+	if opts.RelativeTo == "" {
+		return nil, fmt.Errorf("the relative-to path must be defined")
+	}
+	if opts.StateDir == "" {
+		return nil, fmt.Errorf("the state dir must be defined")
+	}
+	relPath, err := filepath.Abs(opts.RelativeTo)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		targets = append(targets, ".")
+	}
+
+	emit := emitter{
+		roots:            forEach(opts.Roots, dropTrailingSlash),
+		prune:            forEach(opts.Prune, dropTrailingSlash),
+		tags:             opts.Tags,
+		ignoreErrors:     opts.IgnoreErrors,
+		ignoreKinds:      opts.IgnoreErrorKinds,
+		ignoreIn:         forEach(opts.IgnoreErrorsIn, dropTrailingSlash),
+		owners:           map[string]string{},
+		includes:         map[*packages.Package][]string{},
+		partial:          opts.Partial,
+		relPath:          dropTrailingSlash(relPath),
+		imports:          opts.Imports,
+		stateDir:         dropTrailingSlash(opts.StateDir),
+		tests:            opts.Tests,
+		binaries:         opts.Binaries,
+		compile:          opts.Compile,
+		deps:             opts.Deps,
+		graphColor:       opts.GraphColor,
+		graphCollapseStd: opts.GraphCollapseStd,
+		stampMode:        opts.StampMode,
+		debugFn:          opts.Debug,
+		warnFn:           opts.Warn,
+	}
+	emit.debug("targets:", targets)
+	emit.debug("roots:", emit.roots)
+	emit.debug("prune:", emit.prune)
+	emit.debug("tags:", emit.tags)
+	emit.debug("relative-to:", emit.relPath)
+
+	if emit.goWork, err = goEnv("GOWORK"); err != nil {
+		return nil, &LoadError{Err: err}
+	}
+	emit.debug("go.work:", emit.goWork)
+	if emit.deps {
+		if emit.modCache, err = goEnv("GOMODCACHE"); err != nil {
+			return nil, &LoadError{Err: err}
+		}
+		emit.debug("module cache:", emit.modCache)
+	}
+
+	// Each platform and tag set is processed separately, with its own
+	// state dir.
+	variants := []emitter{emit}
+	if len(opts.Platforms) > 0 {
+		variants = nil
+		for _, plat := range opts.Platforms {
+			goos, goarch, ok := strings.Cut(plat, "/")
+			if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+				return nil, fmt.Errorf("invalid platform %q, must be GOOS/GOARCH", plat)
+			}
+			v := emit
+			v.goos, v.goarch = goos, goarch
+			v.stateDir = emit.stateDir + "/" + v.platform()
+			variants = append(variants, v)
+		}
+	}
+	if len(opts.TagSets) > 0 {
+		tagSets, err := parseTagSets(opts.TagSets)
+		if err != nil {
+			return nil, err
+		}
+		perPlatform := variants
+		variants = nil
+		for _, base := range perPlatform {
+			for _, ts := range tagSets {
+				v := base
+				v.tagSet = ts.name
+				v.tags = append(append([]string{}, base.tags...), ts.tags...)
+				v.stateDir = base.stateDir + "/" + ts.name
+				variants = append(variants, v)
+			}
+		}
+	}
+
+	g := &Graph{
+		emit:     emit,
+		variants: variants,
+		multi:    len(opts.Platforms) > 0 || len(opts.TagSets) > 0,
+	}
+	for i, v := range variants {
+		if v.goos != "" || v.tagSet != "" {
+			emit.debug("variant:", v.label())
+		}
+		pkgs, err := v.loadPackages(targets...)
+		if err != nil {
+			return nil, &LoadError{Err: err}
+		}
+		if v.compile {
+			// Every binary needs the runtime, even if nothing imports it.
+			if v.runtime, err = v.loadRuntime(); err != nil {
+				return nil, &LoadError{Err: err}
+			}
+			variants[i] = v
+		}
+		pkgMap, err := v.visitPackages(pkgs)
+		g.ignored = append(g.ignored, v.ignoredErrors(pkgMap)...)
+		if err != nil {
+			// The errors which were ignored are still worth reporting.
+			return &Graph{ignored: g.ignored.dedup()}, err
+		}
+		g.pkgMaps = append(g.pkgMaps, pkgMap)
+		if v.partial {
+			visitEach(pkgMap, func(pkg *packages.Package) {
+				for _, e := range v.brokenErrors(pkg) {
+					g.broken = append(g.broken, newPackageError(pkg, e))
+				}
+			})
+		}
+	}
+	if !g.multi {
+		g.emit = variants[0]
+	}
+	g.ignored = g.ignored.dedup()
+	g.broken = g.broken.dedup()
+	return g, nil
+}
+
+// IgnoredErrors returns the package errors which were ignored, because of
+// IgnoreErrors, IgnoreErrorKinds or IgnoreErrorsIn.
+func (g *Graph) IgnoredErrors() PackageErrors {
+	return g.ignored
+}
+
+// BrokenErrors returns the package errors which, because of Partial, did not
+// fail Load.  The packages are emitted as rules which fail.
+func (g *Graph) BrokenErrors() PackageErrors {
+	return g.broken
+}
+
+// goEnv returns the value of a single `go env` variable.
+func goEnv(name string) (string, error) {
+	out, err := exec.Command("go", "env", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("go env %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func dropTrailingSlash(s string) string {
+	return strings.TrimRight(s, "/")
+}
+
+func forEach(in []string, fn func(s string) string) []string {
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		out = append(out, fn(s))
+	}
+	return out
+}
+
+func (emit emitter) loadPackages(targets ...string) ([]*packages.Package, error) {
+	cfg := emit.loadConfig()
+	return packages.Load(&cfg, targets...)
+}
+
+// loadRuntime loads the runtime package and its dependencies, with export
+// data, for linking.
+func (emit emitter) loadRuntime() (*packages.Package, error) {
+	cfg := emit.loadConfig()
+	cfg.Tests = false
+	pkgs, err := packages.Load(&cfg, "runtime")
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 || len(pkgs[0].Errors) > 0 || pkgs[0].ExportFile == "" {
+		return nil, fmt.Errorf("can't load export data for package runtime")
+	}
+	return pkgs[0], nil
+}
+
+// loadConfig returns the packages.Config for loading packages.
+func (emit emitter) loadConfig() packages.Config {
+	cfg := packages.Config{
+		Mode:       packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedModule | packages.NeedEmbedFiles,
+		Tests:      emit.tests,
+		BuildFlags: []string{"-tags", strings.Join(emit.tags, ",")},
+	}
+	if emit.imports {
+		cfg.Mode |= packages.NeedDeps
+	}
+	if emit.deps {
+		cfg.Mode |= packages.NeedDeps
+	}
+	if emit.compile {
+		// Dependencies outside the main module(s) are compiled by go.
+		cfg.Mode |= packages.NeedDeps | packages.NeedExportFile
+	}
+	cfg.Env = os.Environ()
+	if emit.goos != "" {
+		cfg.Env = append(cfg.Env, "GOOS="+emit.goos, "GOARCH="+emit.goarch)
+	}
+	if emit.deps {
+		// Loading every dependency must not download modules which are
+		// not in the module cache.
+		cfg.Env = append(cfg.Env, "GOPROXY=off")
+	}
+	return cfg
+}
+
+// platform returns the name of the emitter's platform, suitable for use in
+// file names (e.g. "linux_amd64"), or "" if it is the default platform.
+func (emit emitter) platform() string {
+	if emit.goos == "" {
+		return ""
+	}
+	return emit.goos + "_" + emit.goarch
+}
+
+// label returns a human-friendly name for the emitter's platform and tag set,
+// e.g. "linux/amd64", "integration" or "linux/amd64:integration".
+func (emit emitter) label() string {
+	plat := ""
+	if emit.goos != "" {
+		plat = emit.goos + "/" + emit.goarch
+	}
+	switch {
+	case plat != "" && emit.tagSet != "":
+		return plat + ":" + emit.tagSet
+	case plat != "":
+		return plat
+	}
+	return emit.tagSet
+}
+
+// visitPackages visits pkgs and, if enabled, their imports, and returns the
+// packages which should be emitted.  If any of them have errors, and errors
+// are not ignored, PackageErrors listing all of them is also returned.
+func (emit emitter) visitPackages(pkgs []*packages.Package) (map[string]*packages.Package, error) {
+	pkgMap := map[string]*packages.Package{}
+	errs := false
+	for _, p := range pkgs {
+		ok := emit.visitPackage(p, pkgMap)
+		if !ok {
+			errs = true
+		}
+	}
+	if errs && !emit.partial {
+		perrs := PackageErrors{}
+		visitEach(pkgMap, func(pkg *packages.Package) {
+			for _, e := range pkg.Errors {
+				if !emit.ignoreError(pkg, e) {
+					perrs = append(perrs, newPackageError(pkg, e))
+				}
+			}
+		})
+		return pkgMap, perrs
+	}
+	return pkgMap, nil
+}
+
+// ignoreError returns true if the error e in pkg should not fail the run.
+func (emit emitter) ignoreError(pkg *packages.Package, e packages.Error) bool {
+	if emit.ignoreErrors {
+		return true
+	}
+	for _, kind := range emit.ignoreKinds {
+		if kindName(e.Kind) == kind {
+			return true
+		}
+	}
+	if len(emit.ignoreIn) == 0 {
+		return false
+	}
+	// Test variants are ignored along with the package under test.
+	path := pkg.PkgPath
+	if forPkg, ok := testVariantOf(pkg); ok {
+		path = forPkg
+	}
+	if rooted(path, emit.ignoreIn) {
+		return true
+	}
+	// Errors in imports (e.g. of a missing package) are attached to the
+	// imported package, but are positioned in the importer's file.
+	if file, _, _ := parsePos(e.Pos); file != "" {
+		if abs, err := filepath.Abs(file); err == nil && emit.owners[abs] != "" {
+			return rooted(emit.owners[abs], emit.ignoreIn)
+		}
+	}
+	return false
+}
+
+// brokenErrors returns the errors in pkg which were not ignored, if Partial
+// is set, or nil.
+func (emit emitter) brokenErrors(pkg *packages.Package) []packages.Error {
+	if !emit.partial {
+		return nil
+	}
+	var errs []packages.Error
+	for _, e := range pkg.Errors {
+		if !emit.ignoreError(pkg, e) {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// ignoredErrors returns the errors in pkgMap which were ignored.
+func (emit emitter) ignoredErrors(pkgMap map[string]*packages.Package) PackageErrors {
+	ignored := PackageErrors{}
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			if emit.ignoreError(pkg, e) {
+				ignored = append(ignored, newPackageError(pkg, e))
+			}
+		}
+	})
+	return ignored
+}
+
+func (emit emitter) visitPackage(pkg *packages.Package, pkgMap map[string]*packages.Package) bool {
+	emit.debug("visiting package", pkg.ID)
+
+	// Test variants are stored by ID, so they don't collide with the package
+	// under test, but are filtered by the path of the package under test.
+	key, path := pkg.PkgPath, pkg.PkgPath
+	if isTestMain(pkg) {
+		emit.debug("  ", pkg.ID, "is a generated test main")
+		return true
+	}
+	if forPkg, ok := testVariantOf(pkg); ok {
+		if isTestOf(pkg, forPkg) {
+			key, path = pkg.ID, forPkg
+		} else if pkgMap[pkg.PkgPath] != nil {
+			// This is a dependency recompiled for a test.  The files are the
+			// same, so the real package is good enough.
+			emit.debug("  ", pkg.ID, "is a test dependency which was already visited")
+			return true
+		}
+	}
+
+	if pkgMap[key] == pkg {
+		emit.debug("  ", key, "was already visited")
+		return true
+	}
+
+	if len(emit.roots) > 0 && !rooted(path, emit.roots) {
+		emit.debug("  ", key, "is not under an allowed root")
+		return true
+	}
+
+	if len(emit.prune) > 0 && rooted(path, emit.prune) {
+		emit.debug("  ", key, "pruned")
+		return true
+	}
+
+	emit.debug("  ", key, "is new")
+	pkgMap[key] = pkg
+	if emit.owners != nil {
+		for _, f := range pkg.GoFiles {
+			emit.owners[f] = path
+		}
+	}
+	if emit.includes != nil {
+		emit.includes[pkg] = emit.cIncludes(pkg)
+	}
+
+	ok := true
+	for _, e := range pkg.Errors {
+		if emit.ignoreError(pkg, e) {
+			emit.debug("    ignoring error:", e.Msg)
+		} else {
+			ok = false
+		}
+	}
+
+	// Don't recurse if we have errors already.
+	if ok && emit.imports && len(pkg.Imports) > 0 {
+		emit.debug("  ", key, "has", len(pkg.Imports), "imports")
+
+		visitEach(pkg.Imports, func(imp *packages.Package) {
+			if !emit.visitPackage(imp, pkgMap) {
+				ok = false
+			}
+		})
+	}
+
+	return ok
+}
+
+// testVariantOf returns the path of the package under test if pkg is a
+// variant built for a test (e.g. "example.com/pkg [example.com/pkg.test]").
+func testVariantOf(pkg *packages.Package) (string, bool) {
+	i := strings.Index(pkg.ID, " [")
+	if i < 0 || !strings.HasSuffix(pkg.ID, ".test]") {
+		return "", false
+	}
+	return pkg.ID[i+len(" [") : len(pkg.ID)-len(".test]")], true
+}
+
+// isTestOf returns true if pkg is the in-package or external (_test) test
+// variant of forPkg, as opposed to a dependency recompiled for the test.
+func isTestOf(pkg *packages.Package, forPkg string) bool {
+	return pkg.PkgPath == forPkg || pkg.PkgPath == forPkg+"_test"
+}
+
+// isTestNode returns true if pkg is an in-package or external test variant.
+func isTestNode(pkg *packages.Package) bool {
+	forPkg, ok := testVariantOf(pkg)
+	return ok && isTestOf(pkg, forPkg)
+}
+
+// isTestMain returns true if pkg is the generated main package of a test
+// binary (e.g. "example.com/pkg.test").
+func isTestMain(pkg *packages.Package) bool {
+	return pkg.Name == "main" && strings.HasSuffix(pkg.ID, ".test") && !strings.Contains(pkg.ID, " [")
+}
+
+func rooted(pkg string, list []string) bool {
+	for _, s := range list {
+		if pkg == s || strings.HasPrefix(pkg, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func visitEach(all map[string]*packages.Package, fn func(pkg *packages.Package)) {
+	for _, k := range keys(all) {
+		fn(all[k])
+	}
+}
+
+func keys(m map[string]*packages.Package) []string {
+	sl := make([]string, 0, len(m))
+	for k := range m {
+		sl = append(sl, k)
+	}
+	sort.Strings(sl)
+	return sl
+}
+
+func maybeRelative(path, relativeTo string) (string, bool) {
+	if path == relativeTo || strings.HasPrefix(path, relativeTo+"/") {
+		return "." + strings.TrimPrefix(path, relativeTo), true
+	}
+	return path, false
+}
+
+// srcFileRE matches the names of files which Go considers to be source files
+// of a package, including non-Go sources used by cgo and the assembler.
+const srcFileRE = `\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$`
+
+// srcFiles returns all of the files which are inputs to pkg, in a stable
+// order and without duplicates.
+func (emit emitter) srcFiles(pkg *packages.Package) []string {
+	dir := ""
+	if len(pkg.GoFiles) > 0 {
+		dir = filepath.Dir(pkg.GoFiles[0])
+	}
+	seen := map[string]bool{}
+	files := []string{}
+	add := func(list []string) {
+		for _, f := range list {
+			if !seen[f] {
+				seen[f] = true
+				files = append(files, f)
+			}
+		}
+	}
+	add(pkg.GoFiles)
+	// For cgo packages these are mostly generated into Go's build cache,
+	// which is not something make should be tracking.
+	for _, f := range pkg.CompiledGoFiles {
+		if filepath.Dir(f) == dir {
+			add([]string{f})
+		}
+	}
+	add(pkg.OtherFiles)
+	// Embedded directories are already expanded into files by Go.
+	add(pkg.EmbedFiles)
+	add(emit.includesOf(pkg))
+	return files
+}
+
+// modFiles returns the files which define a module's dependencies: go.mod,
+// go.sum, vendor/modules.txt and, for main modules, the active go.work.
+func (emit emitter) modFiles(mod *packages.Module) []string {
+	goMod := mod.GoMod
+	if goMod == "" && mod.Replace != nil {
+		goMod = mod.Replace.GoMod
+	}
+	if goMod == "" {
+		return nil
+	}
+	files := []string{goMod}
+	// Modules from the module cache have a <version>.mod file instead, and
+	// they are immutable anyway.
+	if filepath.Base(goMod) != "go.mod" {
+		return files
+	}
+	dir := filepath.Dir(goMod)
+	for _, f := range []string{"go.sum", filepath.Join("vendor", "modules.txt")} {
+		if exists(filepath.Join(dir, f)) {
+			files = append(files, filepath.Join(dir, f))
+		}
+	}
+	if mod.Main && emit.goWork != "" && emit.goWork != "off" {
+		files = append(files, emit.goWork)
+		if sum := emit.goWork + ".sum"; exists(sum) {
+			files = append(files, sum)
+		}
+	}
+	return files
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// toolchainEnv lists the `go env` variables which, when changed, mean that
+// all packages need to be rebuilt.
+var toolchainEnv = []string{
+	"GOVERSION", "GOROOT", "GOOS", "GOARCH",
+	"GO386", "GOAMD64", "GOARM", "GOARM64", "GOMIPS", "GOMIPS64", "GOPPC64", "GORISCV64", "GOWASM",
+	"GOFLAGS", "GOEXPERIMENT", "CGO_ENABLED",
+	"CC", "CXX", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_FFLAGS", "CGO_LDFLAGS",
+}
+
+// emitStampRecipe emits the recipe for a stamp file.  In "mtime" mode the
+// stamp is simply touched.  In "hash" mode the stamp holds a hash of the
+// contents of all of its prerequisites (which includes the hashes in any
+// prerequisite stamps), and is only touched if that changes, so things
+// like switching git branches back and forth do not cause rebuilds.
+func (emit emitter) emitStampRecipe(out io.Writer) {
+	fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+	if emit.stampMode == "hash" {
+		// Read /dev/null so cat does not read stdin when there are no
+		// prerequisites.
+		fmt.Fprintf(out, "\t@cat /dev/null $^ | $(GO2MAKE_HASH) > $@.tmp\n")
+		fmt.Fprintf(out, "\t@if ! cmp -s $@.tmp $@; then \\\n")
+		fmt.Fprintf(out, "\t    cat $@.tmp > $@; \\\n")
+		fmt.Fprintf(out, "\tfi\n")
+		fmt.Fprintf(out, "\t@rm -f $@.tmp\n")
+		return
+	}
+	fmt.Fprintf(out, "\t@touch $@\n")
+}
+
+// modules returns the modules of the packages in pkgMap, sorted by path.
+func modules(pkgMap map[string]*packages.Package) []*packages.Module {
+	mods := map[string]*packages.Module{}
+	for _, pkg := range pkgMap {
+		if pkg.Module != nil && mods[pkg.Module.Path] == nil {
+			mods[pkg.Module.Path] = pkg.Module
+		}
+	}
+	out := make([]*packages.Module, 0, len(mods))
+	for _, mod := range mods {
+		out = append(out, mod)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// modPrereqs returns the prerequisites of a module's _mod stamp.
+func (emit emitter) modPrereqs(mod *packages.Module) []string {
+	prereqs := []string{}
+	for _, f := range emit.modFiles(mod) {
+		rel, _ := maybeRelative(f, emit.relPath)
+		prereqs = append(prereqs, rel)
+	}
+	return prereqs
+}
+
+// pkgPrereqs returns the prerequisites of a package's _pkg stamp.
+func (emit emitter) pkgPrereqs(pkg *packages.Package, pkgMap map[string]*packages.Package) []string {
+	prereqs := []string{}
+	if len(pkg.GoFiles) > 0 {
+		prereqs = append(prereqs, fmt.Sprintf("%s/by-pkg/%s/_files", emit.stateDir, pkg.PkgPath))
+	}
+	prereqs = append(prereqs, fmt.Sprintf("%s/_toolchain", emit.stateDir))
+	if pkg.Module != nil {
+		prereqs = append(prereqs, fmt.Sprintf("%s/by-mod/%s/_mod", emit.stateDir, pkg.Module.Path))
+	}
+	for _, f := range emit.srcFiles(pkg) {
+		rel, _ := maybeRelative(f, emit.relPath)
+		prereqs = append(prereqs, rel)
+	}
+	for _, imp := range keys(pkg.Imports) {
+		if pkgMap[pkg.Imports[imp].PkgPath] != nil {
+			prereqs = append(prereqs, fmt.Sprintf("%s/by-pkg/%s/_pkg", emit.stateDir, pkg.Imports[imp].PkgPath))
+		}
+	}
+	return prereqs
+}
+
+// testPrereqs returns the prerequisites of a package's _test stamp, or nil
+// if the package has no tests.
+func (emit emitter) testPrereqs(pkg *packages.Package, pkgMap map[string]*packages.Package) []string {
+	internal, external := testVariants(pkg, pkgMap)
+	if internal == nil && external == nil {
+		return nil
+	}
+
+	// The in-package test variant includes the package's own files, and
+	// both variants may import things the package already depends on.
+	// Only list the things which are unique to the tests.
+	seenFiles := map[string]bool{}
+	for _, f := range emit.srcFiles(pkg) {
+		seenFiles[f] = true
+	}
+	seenImps := map[string]bool{pkg.PkgPath: true}
+	for _, imp := range pkg.Imports {
+		seenImps[imp.PkgPath] = true
+	}
+	files := []string{}
+	imps := []string{}
+	for _, variant := range []*packages.Package{internal, external} {
+		if variant == nil {
+			continue
+		}
+		for _, f := range emit.srcFiles(variant) {
+			if !seenFiles[f] {
+				seenFiles[f] = true
+				files = append(files, f)
+			}
+		}
+		for _, imp := range variant.Imports {
+			if !seenImps[imp.PkgPath] && pkgMap[imp.PkgPath] != nil {
+				seenImps[imp.PkgPath] = true
+				imps = append(imps, imp.PkgPath)
+			}
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(imps)
+
+	// The tests depend on the package itself, so any change which requires
+	// the package to be rebuilt also requires the tests to be re-run.
+	prereqs := []string{fmt.Sprintf("%s/by-pkg/%s/_pkg", emit.stateDir, pkg.PkgPath)}
+	for _, f := range files {
+		rel, _ := maybeRelative(f, emit.relPath)
+		prereqs = append(prereqs, rel)
+	}
+	for _, imp := range imps {
+		prereqs = append(prereqs, fmt.Sprintf("%s/by-pkg/%s/_pkg", emit.stateDir, imp))
+	}
+	return prereqs
+}
+
+// emitPrereqs emits the first line(s) of a make rule, with one prerequisite
+// per line.
+func emitPrereqs(out io.Writer, target string, prereqs []string) {
+	fmt.Fprintf(out, "%s:", target)
+	for i, p := range prereqs {
+		if i == 0 {
+			fmt.Fprintf(out, " %s", p)
+		} else {
+			fmt.Fprintf(out, " \\\n  %s", p)
+		}
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+func (emit emitter) emitMake(out io.Writer, pkgMap map[string]*packages.Package) {
+	// Emit helpful macros for callers.
+	fmt.Fprintf(out, "# This file is autogenerated.\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "# This variable may be used with $(call). It takes a single argument\n")
+	fmt.Fprintf(out, "# which is the Go package name, e.g. \"example.com/pkg\".\n")
+	fmt.Fprintf(out, "GO2MAKE_BY_PKG = %s/by-pkg/$(1)/_pkg\n", emit.stateDir)
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "# This variable may be used with $(call). It takes a single argument\n")
+	fmt.Fprintf(out, "# which is the local package path, e.g. \"path/pkg\" or \"./path/pkg\".\n")
+	fmt.Fprintf(out, "GO2MAKE_BY_PATH = %s/by-path/./$(patsubst ./%%,%%,$(1))/_pkg\n", emit.stateDir)
+	fmt.Fprintf(out, "\n")
+	emit.emitMakeHashVar(out)
+	emit.emitMakeBinVars(out)
+
+	emit.emitMakeRules(out, pkgMap)
+}
+
+// emitMakeVariants emits rules for multiple platforms and/or tag sets.  Each
+// variant has its own state dir, so rules for the same package do not
+// collide.
+func (emit emitter) emitMakeVariants(out io.Writer, variants []emitter, pkgMaps []map[string]*packages.Package) {
+	platforms := []string{}
+	tagSets := []string{}
+	seen := map[string]bool{}
+	for _, v := range variants {
+		if p := v.platform(); p != "" && !seen["p:"+p] {
+			seen["p:"+p] = true
+			platforms = append(platforms, p)
+		}
+		if ts := v.tagSet; ts != "" && !seen["t:"+ts] {
+			seen["t:"+ts] = true
+			tagSets = append(tagSets, ts)
+		}
+	}
+
+	// Emit helpful macros for callers.
+	fmt.Fprintf(out, "# This file is autogenerated.\n")
+	fmt.Fprintf(out, "\n")
+	if len(platforms) > 0 {
+		fmt.Fprintf(out, "# This variable lists the platforms for which rules are defined.\n")
+		fmt.Fprintf(out, "GO2MAKE_PLATFORMS = %s\n", strings.Join(platforms, " "))
+		fmt.Fprintf(out, "\n")
+	}
+	if len(tagSets) > 0 {
+		fmt.Fprintf(out, "# This variable lists the tag sets for which rules are defined.\n")
+		fmt.Fprintf(out, "GO2MAKE_TAG_SETS = %s\n", strings.Join(tagSets, " "))
+		fmt.Fprintf(out, "\n")
+	}
+	switch {
+	case len(platforms) > 0 && len(tagSets) > 0:
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes three arguments: the\n")
+		fmt.Fprintf(out, "# platform, e.g. \"linux/amd64\" or \"linux_amd64\", the tag set name, and\n")
+		fmt.Fprintf(out, "# the Go package name, e.g. \"example.com/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PKG_PLATFORM_TAG_SET = %s/$(subst /,_,$(1))/$(2)/by-pkg/$(3)/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes three arguments: the\n")
+		fmt.Fprintf(out, "# platform, e.g. \"linux/amd64\" or \"linux_amd64\", the tag set name, and\n")
+		fmt.Fprintf(out, "# the local package path, e.g. \"path/pkg\" or \"./path/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PATH_PLATFORM_TAG_SET = %s/$(subst /,_,$(1))/$(2)/by-path/./$(patsubst ./%%,%%,$(3))/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+	case len(platforms) > 0:
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes two arguments: the\n")
+		fmt.Fprintf(out, "# platform, e.g. \"linux/amd64\" or \"linux_amd64\", and the Go package\n")
+		fmt.Fprintf(out, "# name, e.g. \"example.com/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PKG_PLATFORM = %s/$(subst /,_,$(1))/by-pkg/$(2)/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes two arguments: the\n")
+		fmt.Fprintf(out, "# platform, e.g. \"linux/amd64\" or \"linux_amd64\", and the local\n")
+		fmt.Fprintf(out, "# package path, e.g. \"path/pkg\" or \"./path/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PATH_PLATFORM = %s/$(subst /,_,$(1))/by-path/./$(patsubst ./%%,%%,$(2))/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+	case len(tagSets) > 0:
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes two arguments: the\n")
+		fmt.Fprintf(out, "# tag set name, and the Go package name, e.g. \"example.com/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PKG_TAG_SET = %s/$(1)/by-pkg/$(2)/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# This variable may be used with $(call). It takes two arguments: the\n")
+		fmt.Fprintf(out, "# tag set name, and the local package path, e.g. \"path/pkg\" or\n")
+		fmt.Fprintf(out, "# \"./path/pkg\".\n")
+		fmt.Fprintf(out, "GO2MAKE_BY_PATH_TAG_SET = %s/$(1)/by-path/./$(patsubst ./%%,%%,$(2))/_pkg\n", emit.stateDir)
+		fmt.Fprintf(out, "\n")
+	}
+	emit.emitMakeHashVar(out)
+	emit.emitMakeBinVars(out)
+
+	if len(tagSets) == 0 {
+		for i, v := range variants {
+			v.emitMakeRules(out, pkgMaps[i])
+		}
+		return
+	}
+
+	// Tag sets are grouped by platform.  Packages which are the same in
+	// every tag set are emitted once, in the platform's state dir, and
+	// each tag set gets rules which refer to those.
+	for i := 0; i < len(variants); i += len(tagSets) {
+		group := variants[i : i+len(tagSets)]
+		groupMaps := pkgMaps[i : i+len(tagSets)]
+		shared := emit.sharedPackages(groupMaps)
+
+		common := group[0]
+		common.tagSet = ""
+		common.tags = emit.tags
+		common.stateDir = filepath.Dir(common.stateDir)
+		common.binaries = false // each tag set builds its own
+		common.compile = false
+		commonMap := map[string]*packages.Package{}
+		for k, pkg := range groupMaps[0] {
+			if shared[k] {
+				commonMap[k] = pkg
+			}
+		}
+		common.emitMakeRules(out, commonMap)
+
+		for j, v := range group {
+			v.shared = shared
+			v.sharedDir = common.stateDir
+			v.emitMakeRules(out, groupMaps[j])
+		}
+	}
+}
+
+func (emit emitter) emitMakeHashVar(out io.Writer) {
+	if emit.stampMode == "hash" {
+		fmt.Fprintf(out, "# This variable is the command used to hash the inputs of stamp files.\n")
+		fmt.Fprintf(out, "GO2MAKE_HASH ?= sha256sum\n")
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+func (emit emitter) emitMakeBinVars(out io.Writer) {
+	if emit.compile {
+		fmt.Fprintf(out, "# This variable is the go command used to compile and link.\n")
+		fmt.Fprintf(out, "GO2MAKE_GO ?= go\n")
+		fmt.Fprintf(out, "\n")
+	}
+	if emit.binaries || emit.compile {
+		fmt.Fprintf(out, "# This variable is the directory into which binaries are built.\n")
+		fmt.Fprintf(out, "GO2MAKE_BIN_DIR ?= bin\n")
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# This variable is the command used to build binaries.\n")
+		fmt.Fprintf(out, "GO2MAKE_GO_BUILD ?= go build\n")
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# These variables are passed to the linker for all binaries, or for just\n")
+		fmt.Fprintf(out, "# one binary, e.g. GO2MAKE_LDFLAGS_<name>.\n")
+		fmt.Fprintf(out, "GO2MAKE_LDFLAGS ?=\n")
+		fmt.Fprintf(out, "\n")
+		fmt.Fprintf(out, "# This variable lists all of the binaries for which rules are defined.\n")
+		fmt.Fprintf(out, "GO2MAKE_BINARIES :=\n")
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+// emitMakeRules emits all of the rules for a single set of packages.
+func (emit emitter) emitMakeRules(out io.Writer, pkgMap map[string]*packages.Package) {
+
+	// Emit a rule to represent the Go toolchain and build environment.  This
+	// rule is evaluated on every run, but the fingerprint file will only get
+	// touched (triggering downstream rebuilds) if the fingerprint actually
+	// changes.  The _force target is never created, so anything which
+	// depends on it is always considered out of date.
+	fmt.Fprintf(out, "%s/_force:\n", emit.stateDir)
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "%s/_toolchain: %s/_force\n", emit.stateDir, emit.stateDir)
+	fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+	goEnvCmd := "go env"
+	if emit.goos != "" {
+		goEnvCmd = fmt.Sprintf("GOOS=%s GOARCH=%s go env", emit.goos, emit.goarch)
+	}
+	fmt.Fprintf(out, "\t@(%s %s; echo 'tags: %s') > $@.tmp\n", goEnvCmd, strings.Join(toolchainEnv, " "), strings.Join(emit.tags, ","))
+	fmt.Fprintf(out, "\t@if ! cmp -s $@.tmp $@; then \\\n")
+	fmt.Fprintf(out, "\t    cat $@.tmp > $@; \\\n")
+	fmt.Fprintf(out, "\tfi\n")
+	fmt.Fprintf(out, "\t@rm -f $@.tmp\n")
+	fmt.Fprintf(out, "\n")
+
+	// Emit rules for each module.  Every package in a module depends on
+	// these, so changes to the module's dependencies trigger rebuilds.
+	for _, mod := range modules(pkgMap) {
+		emitPrereqs(out, fmt.Sprintf("%s/by-mod/%s/_mod", emit.stateDir, mod.Path), emit.modPrereqs(mod))
+		emit.emitStampRecipe(out)
+		fmt.Fprintf(out, "\n")
+	}
+
+	// Emit rules for each package.
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if isTestNode(pkg) {
+			// These are emitted along with the package under test.
+			return
+		}
+
+		codeDir := ""
+		isRel := false
+		if len(pkg.GoFiles) > 0 {
+			codeDir, isRel = maybeRelative(filepath.Dir(pkg.GoFiles[0]), emit.relPath)
+		}
+
+		if errs := emit.brokenErrors(pkg); len(errs) > 0 {
+			emit.emitMakeBroken(out, pkg, errs, codeDir, isRel)
+			return
+		}
+
+		if emit.shared[pkg.PkgPath] {
+			emit.emitMakeShared(out, pkg, pkgMap, codeDir, isRel)
+			return
+		}
+
+		if len(pkg.GoFiles) > 0 {
+			// Emit a rule to represent changes to the directory contents.
+			// This rule will be evaluated whenever the code-directory is
+			// newer than the saved file-list, but the file-list will only get
+			// touched (triggering downstream rebuilds) if the set of files
+			// actually changes.
+			fmt.Fprintf(out, "%s/by-pkg/%s/_files: %s/\n", emit.stateDir, pkg.PkgPath, codeDir)
+			fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+			fmt.Fprintf(out, "\t@ls $< | grep -E '%s' | LC_ALL=C sort > $@.tmp\n", srcFileRE)
+			fmt.Fprintf(out, "\t@if ! cmp -s $@.tmp $@; then \\\n")
+			fmt.Fprintf(out, "\t    cat $@.tmp > $@; \\\n")
+			fmt.Fprintf(out, "\tfi\n")
+			fmt.Fprintf(out, "\t@rm -f $@.tmp\n")
+			fmt.Fprintf(out, "\n")
+		}
+
+		// Emit a rule to represent the whole package.  This uses a file,
+		// rather than the directory itself, to avoid nested dir creation
+		// changing the directory's timestamp.
+		emitPrereqs(out, fmt.Sprintf("%s/by-pkg/%s/_pkg", emit.stateDir, pkg.PkgPath), emit.pkgPrereqs(pkg, pkgMap))
+		emit.emitStampRecipe(out)
+		fmt.Fprintf(out, "\n")
+
+		if isRel {
+			// Emit a rule to represent the package, but by a relative path.  This
+			// is useful when you know the path to something but maybe not which Go
+			// package it is (e.g. you have a bunch of packages).  Like the by-pkg
+			// equivalent, this uses a file, to avoid nested dir creation changing
+			// the directory's timestamp.
+			fmt.Fprintf(out, "%s/by-path/%s/_pkg: %s/by-pkg/%s/_pkg\n", emit.stateDir, codeDir, emit.stateDir, pkg.PkgPath)
+			fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+			fmt.Fprintf(out, "\t@touch $@\n")
+			fmt.Fprintf(out, "\n")
+		}
+
+		emit.emitMakeGenerate(out, pkg, pkgMap, codeDir, isRel)
+
+		if emit.tests {
+			emit.emitMakeTest(out, pkg, pkgMap, codeDir, isRel)
+		}
+	})
+
+	if emit.compile {
+		emit.emitMakeCompile(out, pkgMap)
+	} else if emit.binaries {
+		emit.emitMakeBinaries(out, pkgMap, emit.mainsByName(pkgMap), nil)
+	}
+}
+
+// emitMakeBinaries emits rules to build each main package in pkgMap which
+// owns its binary name in mains, except those in skip.
+func (emit emitter) emitMakeBinaries(out io.Writer, pkgMap map[string]*packages.Package, mains map[string]*packages.Package, skip map[string]bool) {
+	tags := ""
+	if len(emit.tags) > 0 {
+		tags = " -tags=" + strings.Join(emit.tags, ",")
+	}
+
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		name := binName(pkg.PkgPath)
+		if mains[name] != pkg || skip[pkg.PkgPath] {
+			return
+		}
+
+		bin := emit.binDir() + "/" + name
+		fmt.Fprintf(out, "GO2MAKE_BINARIES += %s\n", bin)
+		fmt.Fprintf(out, "%s: %s/by-pkg/%s/_pkg\n", bin, emit.stateDir, pkg.PkgPath)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		fmt.Fprintf(out, "\t%s$(GO2MAKE_GO_BUILD)%s -ldflags \"$(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_%s)\" -o $@ %s\n", emit.platformEnv(), tags, name, pkg.PkgPath)
+		fmt.Fprintf(out, "\n")
+	})
+}
+
+// mainsByName returns the main packages in pkgMap, keyed by the name of the
+// binary each one builds.  Go binaries are named for their package, so two
+// mains can build the same binary; the first one, in package path order,
+// wins and the others are skipped with a warning.
+func (emit emitter) mainsByName(pkgMap map[string]*packages.Package) map[string]*packages.Package {
+	mains := map[string]*packages.Package{}
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if pkg.Name != "main" || isTestNode(pkg) {
+			return
+		}
+		name := binName(pkg.PkgPath)
+		if other, found := mains[name]; found {
+			emit.warn("packages %q and %q both build binary %q, skipping the latter", other.PkgPath, pkg.PkgPath, name)
+			return
+		}
+		mains[name] = pkg
+	})
+	return mains
+}
+
+// binDir returns the directory into which binaries are built, which is
+// specific to the platform and tag set, if there is one.
+func (emit emitter) binDir() string {
+	binDir := "$(GO2MAKE_BIN_DIR)"
+	if p := emit.platform(); p != "" {
+		binDir += "/" + p
+	}
+	if emit.tagSet != "" {
+		binDir += "/" + emit.tagSet
+	}
+	return binDir
+}
+
+// platformEnv returns the environment variables, if any, which need to be
+// set for go commands to build for the emitter's platform.
+func (emit emitter) platformEnv() string {
+	if emit.goos == "" {
+		return ""
+	}
+	return fmt.Sprintf("GOOS=%s GOARCH=%s ", emit.goos, emit.goarch)
+}
+
+// binName returns the name of the binary that `go build` would produce for
+// the named main package, e.g. "example.com/cmd/foo/v2" is "foo".
+func binName(pkgPath string) string {
+	elems := strings.Split(pkgPath, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	return name
+}
+
+// emitMakeShared emits rules for a package which is identical in all tag
+// sets, and so has its real rules in the shared state dir.
+func (emit emitter) emitMakeShared(out io.Writer, pkg *packages.Package, pkgMap map[string]*packages.Package, codeDir string, isRel bool) {
+	stamps := []string{"_pkg"}
+	if len(pkg.GoFiles) > 0 && len(emit.goGenerates(pkg)) > 0 {
+		stamps = append(stamps, "_generate")
+	}
+	if emit.tests && hasTests(pkg, pkgMap) {
+		stamps = append(stamps, "_test")
+	}
+	for _, stamp := range stamps {
+		fmt.Fprintf(out, "%s/by-pkg/%s/%s: %s/by-pkg/%s/%s\n", emit.stateDir, pkg.PkgPath, stamp, emit.sharedDir, pkg.PkgPath, stamp)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		fmt.Fprintf(out, "\t@touch $@\n")
+		fmt.Fprintf(out, "\n")
+
+		if isRel {
+			fmt.Fprintf(out, "%s/by-path/%s/%s: %s/by-pkg/%s/%s\n", emit.stateDir, codeDir, stamp, emit.stateDir, pkg.PkgPath, stamp)
+			fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+			fmt.Fprintf(out, "\t@touch $@\n")
+			fmt.Fprintf(out, "\n")
+		}
+	}
+}
+
+// emitMakeGenerate emits rules to run `go generate` for pkg, if it has any
+// //go:generate directives.
+func (emit emitter) emitMakeGenerate(out io.Writer, pkg *packages.Package, pkgMap map[string]*packages.Package, codeDir string, isRel bool) {
+	if len(pkg.GoFiles) == 0 {
+		return
+	}
+	dirs := emit.goGenerates(pkg)
+	if len(dirs) == 0 {
+		return
+	}
+
+	// Emit a rule to represent the generated code.  This depends on the
+	// set of files, the files which hold the directives, any existing
+	// files named as arguments to the generators, and any generators which
+	// are built from this repo.
+	prereqs := []string{fmt.Sprintf("%s/by-pkg/%s/_files", emit.stateDir, pkg.PkgPath)}
+	for _, f := range generateInputs(pkg, dirs) {
+		rel, _ := maybeRelative(f, emit.relPath)
+		prereqs = append(prereqs, rel)
+	}
+	for _, tool := range generateTools(pkg, dirs, pkgMap) {
+		prereqs = append(prereqs, fmt.Sprintf("%s/by-pkg/%s/_pkg", emit.stateDir, tool))
+	}
+	emitPrereqs(out, fmt.Sprintf("%s/by-pkg/%s/_generate", emit.stateDir, pkg.PkgPath), prereqs)
+	tags := ""
+	if len(emit.tags) > 0 {
+		tags = " -tags=" + strings.Join(emit.tags, ",")
+	}
+	fmt.Fprintf(out, "\t%sgo generate%s %s\n", emit.platformEnv(), tags, pkg.PkgPath)
+	fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+	fmt.Fprintf(out, "\t@touch $@\n")
+	fmt.Fprintf(out, "\n")
+
+	if isRel {
+		fmt.Fprintf(out, "%s/by-path/%s/_generate: %s/by-pkg/%s/_generate\n", emit.stateDir, codeDir, emit.stateDir, pkg.PkgPath)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		fmt.Fprintf(out, "\t@touch $@\n")
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+// emitMakeBroken emits a _pkg rule for a package which could not be loaded.
+// It is always out of date, and prints the errors and fails, so only the
+// targets which depend on the package fail.
+func (emit emitter) emitMakeBroken(out io.Writer, pkg *packages.Package, errs []packages.Error, codeDir string, isRel bool) {
+	fmt.Fprintf(out, "%s/by-pkg/%s/_pkg: %s/_force\n", emit.stateDir, pkg.PkgPath, emit.stateDir)
+	fmt.Fprintf(out, "\t@rm -f $@\n")
+	fmt.Fprintf(out, "\t@echo %s >&2\n", makeShellQuote("go2make: package "+pkg.PkgPath+" has errors:"))
+	for _, e := range errs {
+		for _, line := range strings.Split(e.Error(), "\n") {
+			fmt.Fprintf(out, "\t@echo %s >&2\n", makeShellQuote("    "+line))
+		}
+	}
+	fmt.Fprintf(out, "\t@false\n")
+	fmt.Fprintf(out, "\n")
+
+	if isRel {
+		fmt.Fprintf(out, "%s/by-path/%s/_pkg: %s/by-pkg/%s/_pkg\n", emit.stateDir, codeDir, emit.stateDir, pkg.PkgPath)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		fmt.Fprintf(out, "\t@touch $@\n")
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+// makeShellQuote quotes s as a single shell word, in a make recipe.
+func makeShellQuote(s string) string {
+	s = "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// testVariants returns the in-package and external test variants of pkg, if
+// they were loaded.
+func testVariants(pkg *packages.Package, pkgMap map[string]*packages.Package) (internal, external *packages.Package) {
+	internal = pkgMap[fmt.Sprintf("%s [%s.test]", pkg.PkgPath, pkg.PkgPath)]
+	external = pkgMap[fmt.Sprintf("%s_test [%s.test]", pkg.PkgPath, pkg.PkgPath)]
+	return internal, external
+}
+
+func hasTests(pkg *packages.Package, pkgMap map[string]*packages.Package) bool {
+	internal, external := testVariants(pkg, pkgMap)
+	return internal != nil || external != nil
+}
+
+// emitMakeTest emits rules for the tests of pkg, if it has any.
+func (emit emitter) emitMakeTest(out io.Writer, pkg *packages.Package, pkgMap map[string]*packages.Package, codeDir string, isRel bool) {
+	prereqs := emit.testPrereqs(pkg, pkgMap)
+	if prereqs == nil {
+		return
+	}
+
+	// Emit a rule to represent the package's tests.
+	emitPrereqs(out, fmt.Sprintf("%s/by-pkg/%s/_test", emit.stateDir, pkg.PkgPath), prereqs)
+	emit.emitStampRecipe(out)
+	fmt.Fprintf(out, "\n")
+
+	if isRel {
+		fmt.Fprintf(out, "%s/by-path/%s/_test: %s/by-pkg/%s/_test\n", emit.stateDir, codeDir, emit.stateDir, pkg.PkgPath)
+		fmt.Fprintf(out, "\t@mkdir -p $(@D)\n")
+		fmt.Fprintf(out, "\t@touch $@\n")
+		fmt.Fprintf(out, "\n")
+	}
+}
+
+// emitJSONRaw emits the packages in pkgMap exactly as go/packages returned
+// them.  The format of this is not stable.
+func (emit emitter) emitJSONRaw(out io.Writer, pkgMap map[string]*packages.Package) error {
+	return emitJSONValue(out, pkgMap)
+}
+
+// emitJSONRawVariants emits a raw JSON object keyed by platform and/or tag
+// set.
+func (emit emitter) emitJSONRawVariants(out io.Writer, variants []emitter, pkgMaps []map[string]*packages.Package) error {
+	all := map[string]map[string]*packages.Package{}
+	for i, v := range variants {
+		all[v.label()] = pkgMaps[i]
+	}
+	return emitJSONValue(out, all)
+}
+
+func emitJSONValue(out io.Writer, val interface{}) error {
+	jb, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	_, err = fmt.Fprintln(out, string(jb))
+	return err
+}
@@ -0,0 +1,3546 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+	"golang.org/x/tools/go/packages"
+)
+
+func initModule(t *testing.T, name string, files map[string]string) string {
+	dir := t.TempDir()
+	writeFile(t, dir, "go.mod", dedent.Dedent(`
+		module example.com/mod
+		go 1.18
+	`))
+	for path, content := range files {
+		writeFile(t, dir, path, content)
+	}
+	return dir
+}
+
+// chdirModule creates a module, as initModule does, and makes it the working
+// directory until the test ends.
+func chdirModule(t *testing.T, name string, files map[string]string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := initModule(t, name, files)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return dir
+}
+
+// loadModule loads and visits the packages named by targets, failing the
+// test if there are errors.
+func loadModule(t *testing.T, emit emitter, targets ...string) map[string]*packages.Package {
+	t.Helper()
+	pkgs, err := emit.loadPackages(targets...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pkgMap, err := emit.visitPackages(pkgs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return pkgMap
+}
+
+func writeFile(t *testing.T, dir, path, content string) {
+	path = filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// build a map of pkg -> filenames
+func pkgFiles(pkgs []*packages.Package) map[string][]string {
+	out := make(map[string][]string, len(pkgs))
+	for _, p := range pkgs {
+		skip := false
+		for _, e := range p.Errors {
+			// Some test cases try bad patterns on purpose.
+			if e.Kind == packages.ListError {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		files := make([]string, 0, len(p.GoFiles))
+		for _, f := range p.GoFiles {
+			files = append(files, filepath.Base(f))
+		}
+		out[p.PkgPath] = files
+	}
+	return out
+}
+
+func TestLoadPackages(t *testing.T) {
+	cases := []struct {
+		name       string
+		files      map[string]string
+		tags       []string
+		goos       string
+		goarch     string
+		expectPkgs map[string][]string
+	}{{
+		name: "one_pkg_no_imports",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod": {"file.go"},
+		},
+	}, {
+		name: "one_pkg_with_other_files",
+		files: map[string]string{
+			"README": "",
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+			"file_test.go": dedent.Dedent(`
+				package p
+				var T string
+			`),
+			"_ignore.go": dedent.Dedent(`
+				package p
+				var I string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod": {"file.go"},
+		},
+	}, {
+		name: "one_pkg_with_imports",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod": {"file.go"},
+		},
+	}, {
+		name: "multi_pkg_no_imports",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				package p2
+				var V string
+			`),
+			"p3/file3.go": dedent.Dedent(`
+				package p3
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+			"example.com/mod/p2": {"file2.go"},
+			"example.com/mod/p3": {"file3.go"},
+		},
+	}, {
+		name: "multi_pkg_with_imports",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				package p2
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+			"p3/file3.go": dedent.Dedent(`
+				package p3
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+			"example.com/mod/p2": {"file2.go"},
+			"example.com/mod/p3": {"file3.go"},
+		},
+	}, {
+		name: "multi_pkg_with_tags",
+		tags: []string{"foo"},
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				//go:build !foo
+				// +build !foo
+				package p2
+				var V string
+			`),
+			"p3/file3.go": dedent.Dedent(`
+				//go:build foo
+				// +build foo
+				package p3
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+			"example.com/mod/p3": {"file3.go"},
+		},
+	}, {
+		name: "multi_pkg_multi_file_with_tags",
+		tags: []string{"foo", "bar"},
+		files: map[string]string{
+			"p1/file1a.go": dedent.Dedent(`
+				package p1
+				var Va string
+			`),
+			"p1/file1b.go": dedent.Dedent(`
+				package p1
+				var Vb string
+			`),
+			"p2/file2a.go": dedent.Dedent(`
+				//go:build !foo
+				// +build !foo
+				package p2
+				var Va string
+			`),
+			"p2/file2b.go": dedent.Dedent(`
+				package p2
+				var Vb string
+			`),
+			"p3/file3a.go": dedent.Dedent(`
+				//go:build bar
+				// +build bar
+				package p3
+				var Va string
+			`),
+			"p3/file3b.go": dedent.Dedent(`
+				package p3
+				var Vb string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1a.go", "file1b.go"},
+			"example.com/mod/p2": {"file2b.go"},
+			"example.com/mod/p3": {"file3a.go", "file3b.go"},
+		},
+	}, {
+		name:   "multi_pkg_with_platform",
+		goos:   "darwin",
+		goarch: "arm64",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p1/file1_linux.go": dedent.Dedent(`
+				package p1
+				var L string
+			`),
+			"p1/file1_darwin.go": dedent.Dedent(`
+				package p1
+				var D string
+			`),
+			"p2/file2_amd64.go": dedent.Dedent(`
+				package p2
+				var A string
+			`),
+			"p2/file2_arm64.go": dedent.Dedent(`
+				package p2
+				var A string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go", "file1_darwin.go"},
+			"example.com/mod/p2": {"file2_arm64.go"},
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			chdirModule(t, "example.com/mod", tc.files)
+
+			emit := emitter{
+				tags:   tc.tags,
+				goos:   tc.goos,
+				goarch: tc.goarch,
+			}
+
+			for _, pattern := range []string{"example.com/mod/...", "./..."} {
+				pkgs, err := emit.loadPackages(pattern)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if want, got := tc.expectPkgs, pkgFiles(pkgs); !cmp.Equal(want, got) {
+					t.Errorf("wrong result for pattern %q:\n\twant: %v\n\t got: %v", pattern, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPackagesMultiModule(t *testing.T) {
+	cases := []struct {
+		name          string
+		files         map[string]string
+		tags          []string
+		expectPkgs    map[string][]string
+		testSubByPath bool
+	}{{
+		name: "one_pkg",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod": {"file.go"},
+		},
+	}, {
+		name: "multi_pkg",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				package p2
+				var V string
+			`),
+			"p3/file3.go": dedent.Dedent(`
+				package p3
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+			"example.com/mod/p2": {"file2.go"},
+			"example.com/mod/p3": {"file3.go"},
+		},
+	}, {
+		name: "multi_module_no_workspace",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"m2/go.mod": dedent.Dedent(`
+				module example.com/m2
+				go 1.18
+			`),
+			"m2/file2.go": dedent.Dedent(`
+				package m2
+				var V string
+			`),
+			"m3/go.mod": dedent.Dedent(`
+				module example.com/m3
+				go 1.18
+			`),
+			"m3/file3.go": dedent.Dedent(`
+				package m3
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+		},
+	}, {
+		name: "multi_module_workspace",
+		files: map[string]string{
+			"go.work": dedent.Dedent(`
+				go 1.18
+				use (
+					.
+					./m2
+				)
+				replace (
+					example.com/m2 v0.0.0 => ./m2
+				)
+			`),
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"m2/go.mod": dedent.Dedent(`
+				module example.com/m2
+				go 1.18
+			`),
+			"m2/file2.go": dedent.Dedent(`
+				package m2
+				var V string
+			`),
+			"m3/go.mod": dedent.Dedent(`
+				module example.com/m3
+				go 1.18
+			`),
+			"m3/file3.go": dedent.Dedent(`
+				package m3
+				var V string
+			`),
+		},
+		expectPkgs: map[string][]string{
+			"example.com/mod/p1": {"file1.go"},
+			"example.com/m2":     {"file2.go"},
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			emit := emitter{
+				tags: tc.tags,
+			}
+
+			chdirModule(t, "example.com/mod", tc.files)
+
+			for _, pattern := range [][]string{{"example.com/mod/...", "example.com/m2/..."}, {"./...", "./m2/..."}, {"all"}} {
+				pkgs, err := emit.loadPackages(pattern...)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if want, got := tc.expectPkgs, pkgFiles(pkgs); !cmp.Equal(want, got) {
+					t.Errorf("wrong result for pattern(s) %q:\n\twant: %v\n\t got: %v", pattern, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestVisitPackage(t *testing.T) {
+	pkgpath := "example.com/mod/pkg"
+
+	cases := []struct {
+		name       string
+		pkg        packages.Package
+		initMap    func(pkgMap map[string]*packages.Package, pkg *packages.Package) // optional
+		expectErrs bool
+	}{{
+		name: "already_present",
+		pkg: packages.Package{
+			PkgPath: pkgpath,
+		},
+		initMap: func(pkgMap map[string]*packages.Package, pkg *packages.Package) {
+			pkgMap[pkgpath] = pkg
+		},
+	}, {
+		name: "success",
+		pkg: packages.Package{
+			PkgPath: pkgpath,
+		},
+	}, {
+		name: "list_error",
+		pkg: packages.Package{
+			PkgPath: pkgpath,
+			Errors:  []packages.Error{{Kind: packages.ListError}},
+		},
+		expectErrs: true,
+	}, {
+		name: "parse_error",
+		pkg: packages.Package{
+			PkgPath: pkgpath,
+			Errors: []packages.Error{{
+				Kind: packages.ParseError,
+			}},
+		},
+		expectErrs: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgMap := map[string]*packages.Package{}
+			if tc.initMap != nil {
+				tc.initMap(pkgMap, &tc.pkg)
+			}
+			emit := emitter{}
+
+			ok := emit.visitPackage(&tc.pkg, pkgMap)
+			if ok && tc.expectErrs {
+				t.Errorf("unexpected success")
+			}
+			if !ok && !tc.expectErrs {
+				t.Errorf("unexpected failure")
+			}
+			if want, got := 1, len(pkgMap); want != got {
+				t.Errorf("unexpected number of packages: want %d, got %d, %v", want, got, pkgMap)
+			}
+			if p, found := pkgMap[pkgpath]; !found {
+				t.Errorf("package %q not found in map: %v", pkgpath, pkgMap)
+			} else if p != &tc.pkg {
+				t.Errorf("package %q in map is different pointer: %v", pkgpath, p)
+			}
+		})
+	}
+}
+
+// The preamble emitted by emitMake with a state-dir of ".go2make".
+var makeHeader = dedent.Dedent(`
+	# This file is autogenerated.
+
+	# This variable may be used with $(call). It takes a single argument
+	# which is the Go package name, e.g. "example.com/pkg".
+	GO2MAKE_BY_PKG = .go2make/by-pkg/$(1)/_pkg
+
+	# This variable may be used with $(call). It takes a single argument
+	# which is the local package path, e.g. "path/pkg" or "./path/pkg".
+	GO2MAKE_BY_PATH = .go2make/by-path/./$(patsubst ./%,%,$(1))/_pkg
+
+	.go2make/_force:
+
+	.go2make/_toolchain: .go2make/_force
+		@mkdir -p $(@D)
+		@(go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: ') > $@.tmp
+		@if ! cmp -s $@.tmp $@; then \
+		    cat $@.tmp > $@; \
+		fi
+		@rm -f $@.tmp
+`)
+
+func TestEmitMake(t *testing.T) {
+	cases := []struct {
+		name      string
+		files     map[string]string
+		tags      []string
+		tests     bool
+		binaries  bool
+		stampMode string
+		header    string // optional, defaults to makeHeader
+		expect    string
+	}{{
+		name: "one_pkg_no_imports",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/_files: ./
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_pkg: .go2make/by-pkg/example.com/mod/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./file.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./_pkg: .go2make/by-pkg/example.com/mod/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "one_pkg_with_other_files",
+		files: map[string]string{
+			"README": "",
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+			"file_test.go": dedent.Dedent(`
+				package p
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+			"_ignore.go": dedent.Dedent(`
+				package p
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/_files: ./
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_pkg: .go2make/by-pkg/example.com/mod/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./file.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./_pkg: .go2make/by-pkg/example.com/mod/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "one_pkg_with_imports",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				import "io"
+				import "os"
+				func init() { io.WriteString(os.Stdout, "") }
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/_files: ./
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_pkg: .go2make/by-pkg/example.com/mod/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./file.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./_pkg: .go2make/by-pkg/example.com/mod/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "multi_pkg_no_imports",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				package p2
+				import "example.com/mod/p1"
+				var V = p1.V
+			`),
+			"p3/file3.go": dedent.Dedent(`
+				package p3
+				import "example.com/mod/p1"
+				import "example.com/mod/p2"
+				var V = p1.V + p2.V
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p2/_files: ./p2/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p2/_pkg: .go2make/by-pkg/example.com/mod/p2/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p2/file2.go \
+			  .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p2/_pkg: .go2make/by-pkg/example.com/mod/p2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p3/_files: ./p3/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p3/_pkg: .go2make/by-pkg/example.com/mod/p3/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p3/file3.go \
+			  .go2make/by-pkg/example.com/mod/p1/_pkg \
+			  .go2make/by-pkg/example.com/mod/p2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p3/_pkg: .go2make/by-pkg/example.com/mod/p3/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "multi_module_workspace",
+		files: map[string]string{
+			"go.work": dedent.Dedent(`
+				go 1.18
+				use (
+					.
+					./m2
+				)
+				replace (
+					example.com/m2 v0.0.0 => ./m2
+				)
+			`),
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				import "example.com/m2"
+				var V = m2.V
+			`),
+			"m2/go.mod": dedent.Dedent(`
+				module example.com/m2
+				go 1.18
+			`),
+			"m2/file2.go": dedent.Dedent(`
+				package m2
+				var V string
+			`),
+			"m3/go.mod": dedent.Dedent(`
+				module example.com/m3
+				go 1.18
+			`),
+			"m3/file3.go": dedent.Dedent(`
+				package m3
+				var V string
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/m2/_mod: ./m2/go.mod \
+			  ./go.work
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod \
+			  ./go.work
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/m2/_files: ./m2/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/m2/_pkg: .go2make/by-pkg/example.com/m2/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/m2/_mod \
+			  ./m2/file2.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./m2/_pkg: .go2make/by-pkg/example.com/m2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go \
+			  .go2make/by-pkg/example.com/m2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "go_sum_and_vendor",
+		files: map[string]string{
+			"go.sum":             "",
+			"vendor/modules.txt": "",
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod \
+			  ./go.sum \
+			  ./vendor/modules.txt
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/_files: ./
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_pkg: .go2make/by-pkg/example.com/mod/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./file.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./_pkg: .go2make/by-pkg/example.com/mod/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "embed",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				import "embed"
+				//go:embed static file.tmpl
+				var F embed.FS
+			`),
+			"p1/file.tmpl":        "",
+			"p1/static/a.txt":     "",
+			"p1/static/sub/b.txt": "",
+			"p1/static/sub/c.txt": "",
+			"p1/unused.tmpl":      "",
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go \
+			  ./p1/file.tmpl \
+			  ./p1/static/a.txt \
+			  ./p1/static/sub/b.txt \
+			  ./p1/static/sub/c.txt
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "other_files",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				func F()
+			`),
+			"p1/asm.s":     "",
+			"p1/defs.h":    "",
+			"p1/blob.syso": "",
+			"p1/README":    "",
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go \
+			  ./p1/defs.h \
+			  ./p1/asm.s \
+			  ./p1/blob.syso
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name: "cgo_includes",
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				// #cgo CFLAGS: -I${SRCDIR}/../include
+				// #include <stdlib.h>
+				// #include "api.h"
+				import "C"
+			`),
+			"p1/impl.c": dedent.Dedent(`
+				#include "local.h"
+				#include "../common/common.h"
+			`),
+			"p1/local.h":       "",
+			"common/common.h":  "",
+			"include/api.h":    `#include "nested.h"`,
+			"include/nested.h": "",
+			"include/unused.h": "",
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go \
+			  ./p1/impl.c \
+			  ./p1/local.h \
+			  ./common/common.h \
+			  ./include/api.h \
+			  ./include/nested.h
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name:      "stamp_mode_hash",
+		stampMode: "hash",
+		files: map[string]string{
+			"file.go": dedent.Dedent(`
+				package p
+				var V string
+			`),
+		},
+		header: strings.Replace(makeHeader, "\n.go2make/_force:", dedent.Dedent(`
+			# This variable is the command used to hash the inputs of stamp files.
+			GO2MAKE_HASH ?= sha256sum
+
+			.go2make/_force:`), 1),
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@cat /dev/null $^ | $(GO2MAKE_HASH) > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@cat /dev/null $^ | $(GO2MAKE_HASH) > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@cat /dev/null $^ | $(GO2MAKE_HASH) > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_files: ./
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/_pkg: .go2make/by-pkg/example.com/mod/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./file.go
+				@mkdir -p $(@D)
+				@cat /dev/null $^ | $(GO2MAKE_HASH) > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-path/./_pkg: .go2make/by-pkg/example.com/mod/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name:  "tests",
+		tests: true,
+		files: map[string]string{
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p2/file2.go": dedent.Dedent(`
+				package p2
+				var V string
+			`),
+			"p2/file2_test.go": dedent.Dedent(`
+				package p2
+				import "example.com/mod/p1"
+				var T = p1.V
+			`),
+			"p2/x_test.go": dedent.Dedent(`
+				package p2_test
+				import "example.com/mod/p2"
+				var X = p2.V
+			`),
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p2/_files: ./p2/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p2/_pkg: .go2make/by-pkg/example.com/mod/p2/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p2/file2.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p2/_pkg: .go2make/by-pkg/example.com/mod/p2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p2/_test: .go2make/by-pkg/example.com/mod/p2/_pkg \
+			  ./p2/file2_test.go \
+			  ./p2/x_test.go \
+			  .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p2/_test: .go2make/by-pkg/example.com/mod/p2/_test
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}, {
+		name:     "binaries",
+		binaries: true,
+		files: map[string]string{
+			"cmd/foo/main.go": dedent.Dedent(`
+				package main
+				func main() {}
+			`),
+			"cmd/bar/v2/main.go": dedent.Dedent(`
+				package main
+				func main() {}
+			`),
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+		},
+		header: strings.Replace(makeHeader, "\n.go2make/_force:", dedent.Dedent(`
+			# This variable is the directory into which binaries are built.
+			GO2MAKE_BIN_DIR ?= bin
+
+			# This variable is the command used to build binaries.
+			GO2MAKE_GO_BUILD ?= go build
+
+			# These variables are passed to the linker for all binaries, or for just
+			# one binary, e.g. GO2MAKE_LDFLAGS_<name>.
+			GO2MAKE_LDFLAGS ?=
+
+			# This variable lists all of the binaries for which rules are defined.
+			GO2MAKE_BINARIES :=
+
+			.go2make/_force:`), 1),
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/cmd/bar/v2/_files: ./cmd/bar/v2/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/cmd/bar/v2/_pkg: .go2make/by-pkg/example.com/mod/cmd/bar/v2/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./cmd/bar/v2/main.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./cmd/bar/v2/_pkg: .go2make/by-pkg/example.com/mod/cmd/bar/v2/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/cmd/foo/_files: ./cmd/foo/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/cmd/foo/_pkg: .go2make/by-pkg/example.com/mod/cmd/foo/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./cmd/foo/main.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./cmd/foo/_pkg: .go2make/by-pkg/example.com/mod/cmd/foo/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			GO2MAKE_BINARIES += $(GO2MAKE_BIN_DIR)/bar
+			$(GO2MAKE_BIN_DIR)/bar: .go2make/by-pkg/example.com/mod/cmd/bar/v2/_pkg
+				@mkdir -p $(@D)
+				$(GO2MAKE_GO_BUILD) -ldflags "$(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_bar)" -o $@ example.com/mod/cmd/bar/v2
+
+			GO2MAKE_BINARIES += $(GO2MAKE_BIN_DIR)/foo
+			$(GO2MAKE_BIN_DIR)/foo: .go2make/by-pkg/example.com/mod/cmd/foo/_pkg
+				@mkdir -p $(@D)
+				$(GO2MAKE_GO_BUILD) -ldflags "$(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_foo)" -o $@ example.com/mod/cmd/foo
+		`),
+	}, {
+		name: "go_generate",
+		files: map[string]string{
+			"gen/main.go": dedent.Dedent(`
+				package main
+				func main() {}
+			`),
+			"p1/file1.go": dedent.Dedent(`
+				package p1
+				//go:generate go run ../gen -in data.yaml "--out=zz_generated.go"
+				//go:generate stringer -type=T $GOFILE
+				type T int
+			`),
+			"p1/file2.go": dedent.Dedent(`
+				package p1
+				var V string
+			`),
+			"p1/data.yaml": "",
+		},
+		expect: dedent.Dedent(`
+			.go2make/by-mod/example.com/mod/_mod: ./go.mod
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m2/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/./m3/.../_pkg: .go2make/_toolchain
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/gen/_files: ./gen/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/gen/_pkg: .go2make/by-pkg/example.com/mod/gen/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./gen/main.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./gen/_pkg: .go2make/by-pkg/example.com/mod/gen/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_files: ./p1/
+				@mkdir -p $(@D)
+				@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+				@if ! cmp -s $@.tmp $@; then \
+				    cat $@.tmp > $@; \
+				fi
+				@rm -f $@.tmp
+
+			.go2make/by-pkg/example.com/mod/p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_files \
+			  .go2make/_toolchain \
+			  .go2make/by-mod/example.com/mod/_mod \
+			  ./p1/file1.go \
+			  ./p1/file2.go
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_pkg: .go2make/by-pkg/example.com/mod/p1/_pkg
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-pkg/example.com/mod/p1/_generate: .go2make/by-pkg/example.com/mod/p1/_files \
+			  ./p1/data.yaml \
+			  ./p1/file1.go \
+			  .go2make/by-pkg/example.com/mod/gen/_pkg
+				go generate example.com/mod/p1
+				@mkdir -p $(@D)
+				@touch $@
+
+			.go2make/by-path/./p1/_generate: .go2make/by-pkg/example.com/mod/p1/_generate
+				@mkdir -p $(@D)
+				@touch $@
+		`),
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := chdirModule(t, "example.com/mod", tc.files)
+
+			emit := emitter{
+				stateDir:     ".go2make",
+				relPath:      dir,
+				ignoreErrors: true, // easier output comparison
+				tests:        tc.tests,
+				binaries:     tc.binaries,
+				stampMode:    tc.stampMode,
+			}
+			if _, found := tc.files["go.work"]; found {
+				emit.goWork = filepath.Join(dir, "go.work")
+			}
+
+			pkgMap := loadModule(t, emit, "./...", "./m2/...", "./m3/...")
+			buf := bytes.Buffer{}
+			emit.emitMake(&buf, pkgMap)
+			header := makeHeader
+			if tc.header != "" {
+				header = tc.header
+			}
+			if want, got := strings.Trim(header+tc.expect, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+				t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+			}
+		})
+	}
+}
+
+func TestEmitMakePlatforms(t *testing.T) {
+	files := map[string]string{
+		"file.go": dedent.Dedent(`
+			package p
+			var V string
+		`),
+		"file_linux.go": dedent.Dedent(`
+			package p
+			var L string
+		`),
+		"file_darwin.go": dedent.Dedent(`
+			package p
+			var D string
+		`),
+	}
+	expect := dedent.Dedent(`
+		# This file is autogenerated.
+
+		# This variable lists the platforms for which rules are defined.
+		GO2MAKE_PLATFORMS = linux_amd64 darwin_arm64
+
+		# This variable may be used with $(call). It takes two arguments: the
+		# platform, e.g. "linux/amd64" or "linux_amd64", and the Go package
+		# name, e.g. "example.com/pkg".
+		GO2MAKE_BY_PKG_PLATFORM = .go2make/$(subst /,_,$(1))/by-pkg/$(2)/_pkg
+
+		# This variable may be used with $(call). It takes two arguments: the
+		# platform, e.g. "linux/amd64" or "linux_amd64", and the local
+		# package path, e.g. "path/pkg" or "./path/pkg".
+		GO2MAKE_BY_PATH_PLATFORM = .go2make/$(subst /,_,$(1))/by-path/./$(patsubst ./%,%,$(2))/_pkg
+
+		.go2make/linux_amd64/_force:
+
+		.go2make/linux_amd64/_toolchain: .go2make/linux_amd64/_force
+			@mkdir -p $(@D)
+			@(GOOS=linux GOARCH=amd64 go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: ') > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/linux_amd64/by-mod/example.com/mod/_mod: ./go.mod
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/linux_amd64/by-pkg/example.com/mod/_files: ./
+			@mkdir -p $(@D)
+			@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/linux_amd64/by-pkg/example.com/mod/_pkg: .go2make/linux_amd64/by-pkg/example.com/mod/_files \
+		  .go2make/linux_amd64/_toolchain \
+		  .go2make/linux_amd64/by-mod/example.com/mod/_mod \
+		  ./file.go \
+		  ./file_linux.go
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/linux_amd64/by-path/./_pkg: .go2make/linux_amd64/by-pkg/example.com/mod/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/darwin_arm64/_force:
+
+		.go2make/darwin_arm64/_toolchain: .go2make/darwin_arm64/_force
+			@mkdir -p $(@D)
+			@(GOOS=darwin GOARCH=arm64 go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: ') > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/darwin_arm64/by-mod/example.com/mod/_mod: ./go.mod
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/darwin_arm64/by-pkg/example.com/mod/_files: ./
+			@mkdir -p $(@D)
+			@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/darwin_arm64/by-pkg/example.com/mod/_pkg: .go2make/darwin_arm64/by-pkg/example.com/mod/_files \
+		  .go2make/darwin_arm64/_toolchain \
+		  .go2make/darwin_arm64/by-mod/example.com/mod/_mod \
+		  ./file.go \
+		  ./file_darwin.go
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/darwin_arm64/by-path/./_pkg: .go2make/darwin_arm64/by-pkg/example.com/mod/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+	`)
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+	}
+	variants := []emitter{}
+	for _, plat := range [][2]string{{"linux", "amd64"}, {"darwin", "arm64"}} {
+		v := emit
+		v.goos, v.goarch = plat[0], plat[1]
+		v.stateDir = emit.stateDir + "/" + v.platform()
+		variants = append(variants, v)
+	}
+
+	pkgMaps := []map[string]*packages.Package{}
+	for _, v := range variants {
+		pkgMaps = append(pkgMaps, loadModule(t, v, "./..."))
+	}
+	buf := bytes.Buffer{}
+	emit.emitMakeVariants(&buf, variants, pkgMaps)
+	if want, got := strings.Trim(expect, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+		t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestEmitMakeTagSets(t *testing.T) {
+	files := map[string]string{
+		"a/file.go": dedent.Dedent(`
+			package a
+			var A string
+		`),
+		"b/file.go": dedent.Dedent(`
+			package b
+			import "example.com/mod/a"
+			var B = a.A
+		`),
+		"b/file_integration.go": dedent.Dedent(`
+			//go:build integration
+			package b
+			var I string
+		`),
+	}
+	expect := dedent.Dedent(`
+		# This file is autogenerated.
+
+		# This variable lists the tag sets for which rules are defined.
+		GO2MAKE_TAG_SETS = unit integration
+
+		# This variable may be used with $(call). It takes two arguments: the
+		# tag set name, and the Go package name, e.g. "example.com/pkg".
+		GO2MAKE_BY_PKG_TAG_SET = .go2make/$(1)/by-pkg/$(2)/_pkg
+
+		# This variable may be used with $(call). It takes two arguments: the
+		# tag set name, and the local package path, e.g. "path/pkg" or
+		# "./path/pkg".
+		GO2MAKE_BY_PATH_TAG_SET = .go2make/$(1)/by-path/./$(patsubst ./%,%,$(2))/_pkg
+
+		.go2make/_force:
+
+		.go2make/_toolchain: .go2make/_force
+			@mkdir -p $(@D)
+			@(go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: ') > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/by-mod/example.com/mod/_mod: ./go.mod
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/by-pkg/example.com/mod/a/_files: ./a/
+			@mkdir -p $(@D)
+			@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/by-pkg/example.com/mod/a/_pkg: .go2make/by-pkg/example.com/mod/a/_files \
+		  .go2make/_toolchain \
+		  .go2make/by-mod/example.com/mod/_mod \
+		  ./a/file.go
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/by-path/./a/_pkg: .go2make/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/unit/_force:
+
+		.go2make/unit/_toolchain: .go2make/unit/_force
+			@mkdir -p $(@D)
+			@(go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: ') > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/unit/by-mod/example.com/mod/_mod: ./go.mod
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/unit/by-pkg/example.com/mod/a/_pkg: .go2make/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/unit/by-path/./a/_pkg: .go2make/unit/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/unit/by-pkg/example.com/mod/b/_files: ./b/
+			@mkdir -p $(@D)
+			@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/unit/by-pkg/example.com/mod/b/_pkg: .go2make/unit/by-pkg/example.com/mod/b/_files \
+		  .go2make/unit/_toolchain \
+		  .go2make/unit/by-mod/example.com/mod/_mod \
+		  ./b/file.go \
+		  .go2make/unit/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/unit/by-path/./b/_pkg: .go2make/unit/by-pkg/example.com/mod/b/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/integration/_force:
+
+		.go2make/integration/_toolchain: .go2make/integration/_force
+			@mkdir -p $(@D)
+			@(go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: integration') > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/integration/by-mod/example.com/mod/_mod: ./go.mod
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/integration/by-pkg/example.com/mod/a/_pkg: .go2make/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/integration/by-path/./a/_pkg: .go2make/integration/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/integration/by-pkg/example.com/mod/b/_files: ./b/
+			@mkdir -p $(@D)
+			@ls $< | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $@.tmp
+			@if ! cmp -s $@.tmp $@; then \
+			    cat $@.tmp > $@; \
+			fi
+			@rm -f $@.tmp
+
+		.go2make/integration/by-pkg/example.com/mod/b/_pkg: .go2make/integration/by-pkg/example.com/mod/b/_files \
+		  .go2make/integration/_toolchain \
+		  .go2make/integration/by-mod/example.com/mod/_mod \
+		  ./b/file.go \
+		  ./b/file_integration.go \
+		  .go2make/integration/by-pkg/example.com/mod/a/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+
+		.go2make/integration/by-path/./b/_pkg: .go2make/integration/by-pkg/example.com/mod/b/_pkg
+			@mkdir -p $(@D)
+			@touch $@
+	`)
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+	}
+	tagSets, err := parseTagSets([]string{"unit:", "integration:integration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := []emitter{}
+	for _, ts := range tagSets {
+		v := emit
+		v.tagSet = ts.name
+		v.tags = ts.tags
+		v.stateDir = emit.stateDir + "/" + ts.name
+		variants = append(variants, v)
+	}
+
+	pkgMaps := []map[string]*packages.Package{}
+	for _, v := range variants {
+		pkgMaps = append(pkgMaps, loadModule(t, v, "./..."))
+	}
+	buf := bytes.Buffer{}
+	emit.emitMakeVariants(&buf, variants, pkgMaps)
+	if want, got := strings.Trim(expect, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+		t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestParseTagSets(t *testing.T) {
+	testCases := []struct {
+		name   string
+		specs  []string
+		expect []tagSet
+		err    bool
+	}{{
+		name:   "empty",
+		specs:  []string{"unit:"},
+		expect: []tagSet{{name: "unit"}},
+	}, {
+		name:   "no_colon",
+		specs:  []string{"unit"},
+		expect: []tagSet{{name: "unit"}},
+	}, {
+		name:   "multi",
+		specs:  []string{"unit:", "e2e:e2e,slow"},
+		expect: []tagSet{{name: "unit"}, {name: "e2e", tags: []string{"e2e", "slow"}}},
+	}, {
+		name:  "bad_name",
+		specs: []string{"a/b:x"},
+		err:   true,
+	}, {
+		name:  "reserved_name",
+		specs: []string{"by-pkg:x"},
+		err:   true,
+	}, {
+		name:  "dup_name",
+		specs: []string{"a:x", "a:y"},
+		err:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sets, err := parseTagSets(tc.specs)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", sets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expect, sets, cmp.AllowUnexported(tagSet{})); diff != "" {
+				t.Errorf("wrong result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCIncludesRoot(t *testing.T) {
+	files := map[string]string{
+		"go.work": dedent.Dedent(`
+			go 1.18
+			use (
+				.
+				./m2
+			)
+		`),
+		"m2/go.mod": dedent.Dedent(`
+			module example.com/m2
+			go 1.18
+		`),
+		"m2/file2.go": dedent.Dedent(`
+			package m2
+			// #include "../include/shared.h"
+			import "C"
+		`),
+		"include/shared.h": "",
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	cases := []struct {
+		name    string
+		goWork  string
+		relPath string
+		expect  []string
+	}{{
+		name:   "module",
+		expect: []string{},
+	}, {
+		name:   "workspace",
+		goWork: filepath.Join(dir, "go.work"),
+		expect: []string{dir + "/include/shared.h"},
+	}, {
+		name:    "relative_to",
+		relPath: dir,
+		expect:  []string{dir + "/include/shared.h"},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			emit := emitter{
+				stateDir: ".go2make",
+				relPath:  tc.relPath,
+				goWork:   tc.goWork,
+			}
+			pkgMap := loadModule(t, emit, "./m2/...")
+			got := emit.cIncludes(pkgMap["example.com/m2"])
+			if diff := cmp.Diff(tc.expect, got); diff != "" {
+				t.Errorf("wrong result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEmitMakeCompile(t *testing.T) {
+	files := map[string]string{
+		"p/p.go": dedent.Dedent(`
+			package p
+			import "strings"
+			func F() string { return strings.ToUpper("x") }
+		`),
+		"q/q.go": dedent.Dedent(`
+			package q
+			import _ "embed"
+			//go:embed q.txt
+			var Q string
+		`),
+		"q/q.txt": "",
+		"cmd/c/main.go": dedent.Dedent(`
+			package main
+			import "example.com/mod/p"
+			func main() { println(p.F()) }
+		`),
+		"cmd/d/main.go": dedent.Dedent(`
+			package main
+			import "example.com/mod/q"
+			func main() { println(q.Q) }
+		`),
+	}
+	// Archives outside the module live in the build cache and the set of
+	// them depends on the Go version, so lines which refer to them are
+	// dropped.
+	exportRE := regexp.MustCompile(`(?m)^\t    'packagefile [^']*=/[^']*' \\\n`)
+	expect := dedent.Dedent(`
+		.go2make/by-pkg/example.com/mod/cmd/c/_importcfg: .go2make/by-pkg/example.com/mod/cmd/c/_pkg
+			@mkdir -p $(@D)
+			@printf '%s\n' \
+			    'packagefile example.com/mod/p=.go2make/by-pkg/example.com/mod/p/_pkg.a' \
+			    > $@
+
+		.go2make/by-pkg/example.com/mod/cmd/c/_pkg.a: .go2make/by-pkg/example.com/mod/cmd/c/_pkg \
+		  .go2make/by-pkg/example.com/mod/cmd/c/_importcfg \
+		  .go2make/by-pkg/example.com/mod/p/_pkg.a
+			@mkdir -p $(@D)
+			$(GO2MAKE_GO) tool compile -o $@ -p main -pack -complete -lang=go1.18 -importcfg .go2make/by-pkg/example.com/mod/cmd/c/_importcfg ./cmd/c/main.go
+
+		.go2make/by-pkg/example.com/mod/cmd/c/_importcfg.link: .go2make/by-pkg/example.com/mod/cmd/c/_pkg
+			@mkdir -p $(@D)
+			@printf '%s\n' \
+			    'packagefile example.com/mod/p=.go2make/by-pkg/example.com/mod/p/_pkg.a' \
+			    > $@
+
+		GO2MAKE_BINARIES += $(GO2MAKE_BIN_DIR)/c
+		$(GO2MAKE_BIN_DIR)/c: .go2make/by-pkg/example.com/mod/cmd/c/_pkg.a .go2make/by-pkg/example.com/mod/cmd/c/_importcfg.link
+			@mkdir -p $(@D)
+			$(GO2MAKE_GO) tool link -o $@ -importcfg .go2make/by-pkg/example.com/mod/cmd/c/_importcfg.link -buildmode=exe $(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_c) .go2make/by-pkg/example.com/mod/cmd/c/_pkg.a
+
+		.go2make/by-pkg/example.com/mod/p/_importcfg: .go2make/by-pkg/example.com/mod/p/_pkg
+			@mkdir -p $(@D)
+			@printf '%s\n' \
+			    > $@
+
+		.go2make/by-pkg/example.com/mod/p/_pkg.a: .go2make/by-pkg/example.com/mod/p/_pkg \
+		  .go2make/by-pkg/example.com/mod/p/_importcfg
+			@mkdir -p $(@D)
+			$(GO2MAKE_GO) tool compile -o $@ -p example.com/mod/p -pack -complete -lang=go1.18 -importcfg .go2make/by-pkg/example.com/mod/p/_importcfg ./p/p.go
+
+		GO2MAKE_BINARIES += $(GO2MAKE_BIN_DIR)/d
+		$(GO2MAKE_BIN_DIR)/d: .go2make/by-pkg/example.com/mod/cmd/d/_pkg
+			@mkdir -p $(@D)
+			$(GO2MAKE_GO_BUILD) -ldflags "$(GO2MAKE_LDFLAGS) $(GO2MAKE_LDFLAGS_d)" -o $@ example.com/mod/cmd/d
+	`)
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		compile:  true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	buf := bytes.Buffer{}
+	emit.emitMakeCompile(&buf, pkgMap)
+	got := exportRE.ReplaceAllString(buf.String(), "")
+	if want, got := strings.Trim(expect, "\n"), strings.Trim(got, "\n"); want != got {
+		t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestEmitMakeCompileLink(t *testing.T) {
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make is not available")
+	}
+
+	files := map[string]string{
+		// Nothing imports the runtime, but the linker still needs it.
+		"cmd/hello/main.go": dedent.Dedent(`
+			package main
+			func main() { println("hello") }
+		`),
+		"Makefile": dedent.Dedent(`
+			include go2make.mk
+			all: $(GO2MAKE_BINARIES)
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+	opts.Compile = true
+	graph, err := Load(opts, "./...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e, err := NewEmitter("compile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := bytes.Buffer{}
+	if err := e.Emit(&buf, graph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeFile(t, dir, "go2make.mk", buf.String())
+
+	if out, err := exec.Command("make", "all").CombinedOutput(); err != nil {
+		t.Fatalf("make failed: %v\n%s", err, out)
+	}
+	if out, err := exec.Command("./bin/hello").CombinedOutput(); err != nil {
+		t.Errorf("binary failed: %v\n%s", err, out)
+	} else if string(out) != "hello\n" {
+		t.Errorf("wrong output: %q", out)
+	}
+}
+
+func TestEmitMakeCompileNameClash(t *testing.T) {
+	files := map[string]string{
+		// This one can't be compiled by make, so it falls back to `go build`.
+		"a/foo/main.go": dedent.Dedent(`
+			package main
+			import _ "embed"
+			//go:embed data.txt
+			var data string
+			func main() { println(data) }
+		`),
+		"a/foo/data.txt": "data\n",
+		"b/foo/main.go": dedent.Dedent(`
+			package main
+			func main() {}
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	warnings := []string{}
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+	opts.Compile = true
+	opts.Warn = func(msg string) {
+		warnings = append(warnings, msg)
+	}
+	graph, err := Load(opts, "./...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e, err := NewEmitter("compile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := bytes.Buffer{}
+	if err := e.Emit(&buf, graph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+
+	if n := strings.Count(out, "GO2MAKE_BINARIES += $(GO2MAKE_BIN_DIR)/foo\n"); n != 1 {
+		t.Errorf("expected 1 rule for binary foo, got %d:\n%s", n, out)
+	}
+	if !strings.Contains(out, "-o $@ example.com/mod/a/foo\n") {
+		t.Errorf("expected a/foo to be built by go build:\n%s", out)
+	}
+	if strings.Contains(out, "_importcfg.link") {
+		t.Errorf("expected b/foo not to be linked:\n%s", out)
+	}
+	expect := []string{`packages "example.com/mod/a/foo" and "example.com/mod/b/foo" both build binary "foo", skipping the latter`}
+	if !cmp.Equal(expect, warnings) {
+		t.Errorf("wrong warnings:\n%s", cmp.Diff(expect, warnings))
+	}
+}
+
+func TestEmitNinja(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			var V string
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+		"p2/file2_test.go": dedent.Dedent(`
+			package p2
+			import "testing"
+			func TestV(t *testing.T) {}
+		`),
+	}
+	expect := dedent.Dedent(`
+		# This file is autogenerated.
+
+		rule go2make_stamp
+		  command = mkdir -p $$(dirname $out) && touch $out
+
+		rule go2make_alias
+		  command = mkdir -p $$(dirname $out) && touch $out
+
+		rule go2make_files
+		  command = mkdir -p $$(dirname $out) && ls $in | grep -E '\.(go|c|cc|cxx|cpp|m|h|hh|hpp|hxx|f|F|for|f90|s|S|sx|swig|swigcxx|syso)$$' | LC_ALL=C sort > $out.tmp && { cmp -s $out.tmp $out || cat $out.tmp > $out; } && rm -f $out.tmp
+		  restat = 1
+
+		rule go2make_toolchain
+		  command = mkdir -p $$(dirname $out) && ($env go env GOVERSION GOROOT GOOS GOARCH GO386 GOAMD64 GOARM GOARM64 GOMIPS GOMIPS64 GOPPC64 GORISCV64 GOWASM GOFLAGS GOEXPERIMENT CGO_ENABLED CC CXX CGO_CFLAGS CGO_CPPFLAGS CGO_CXXFLAGS CGO_FFLAGS CGO_LDFLAGS; echo 'tags: $tags') > $out.tmp && { cmp -s $out.tmp $out || cat $out.tmp > $out; } && rm -f $out.tmp
+		  restat = 1
+
+		build .go2make/_force: phony
+
+		build .go2make/_toolchain: go2make_toolchain | $
+		    .go2make/_force
+
+		build .go2make/by-mod/example.com/mod/_mod: go2make_stamp $
+		    ./go.mod
+
+		build .go2make/by-pkg/example.com/mod/p1/_files: go2make_files $
+		    ./p1/
+
+		build .go2make/by-pkg/example.com/mod/p1/_pkg: go2make_stamp $
+		    .go2make/by-pkg/example.com/mod/p1/_files $
+		    .go2make/_toolchain $
+		    .go2make/by-mod/example.com/mod/_mod $
+		    ./p1/file1.go
+
+		build .go2make/by-path/./p1/_pkg: go2make_alias $
+		    .go2make/by-pkg/example.com/mod/p1/_pkg
+
+		build .go2make/by-pkg/example.com/mod/p2/_files: go2make_files $
+		    ./p2/
+
+		build .go2make/by-pkg/example.com/mod/p2/_pkg: go2make_stamp $
+		    .go2make/by-pkg/example.com/mod/p2/_files $
+		    .go2make/_toolchain $
+		    .go2make/by-mod/example.com/mod/_mod $
+		    ./p2/file2.go $
+		    .go2make/by-pkg/example.com/mod/p1/_pkg
+
+		build .go2make/by-path/./p2/_pkg: go2make_alias $
+		    .go2make/by-pkg/example.com/mod/p2/_pkg
+
+		build .go2make/by-pkg/example.com/mod/p2/_test: go2make_stamp $
+		    .go2make/by-pkg/example.com/mod/p2/_pkg $
+		    ./p2/file2_test.go
+
+		build .go2make/by-path/./p2/_test: go2make_alias $
+		    .go2make/by-pkg/example.com/mod/p2/_test
+	`)
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		tests:    true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	buf := bytes.Buffer{}
+	emit.emitNinja(&buf, pkgMap)
+	if want, got := strings.Trim(expect, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+		t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestEmitBazel(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "embed"
+			//go:embed data.txt
+			var F embed.FS
+		`),
+		"p1/data.txt": "",
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.F
+		`),
+		"p2/file2_test.go": dedent.Dedent(`
+			package p2
+			import "testing"
+			func TestV(t *testing.T) {}
+		`),
+		"cmd/c/main.go": dedent.Dedent(`
+			package main
+			import "example.com/mod/p2"
+			func main() { println(p2.V) }
+		`),
+		"p3/file3.go": dedent.Dedent(`
+			package p3
+		`),
+		"p3/BUILD.bazel": "# hand-written\n",
+	}
+	expect := map[string]string{
+		"p1/BUILD.bazel": dedent.Dedent(`
+			# This file is autogenerated by go2make.  Hand-written rules may be
+			# added between "# go2make:keep-begin" and
+			# "# go2make:keep-end" lines, and will be preserved.
+
+			load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+			go_library(
+			    name = "p1",
+			    srcs = [
+			        "file1.go",
+			    ],
+			    embedsrcs = [
+			        "data.txt",
+			    ],
+			    importpath = "example.com/mod/p1",
+			    visibility = ["//visibility:public"],
+			)
+		`),
+		"p2/BUILD.bazel": dedent.Dedent(`
+			# This file is autogenerated by go2make.  Hand-written rules may be
+			# added between "# go2make:keep-begin" and
+			# "# go2make:keep-end" lines, and will be preserved.
+
+			load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+			go_library(
+			    name = "p2",
+			    srcs = [
+			        "file2.go",
+			    ],
+			    importpath = "example.com/mod/p2",
+			    visibility = ["//visibility:public"],
+			    deps = [
+			        "//p1",
+			    ],
+			)
+
+			go_test(
+			    name = "p2_test",
+			    srcs = [
+			        "file2_test.go",
+			    ],
+			    embed = [":p2"],
+			)
+		`),
+		"cmd/c/BUILD.bazel": dedent.Dedent(`
+			# This file is autogenerated by go2make.  Hand-written rules may be
+			# added between "# go2make:keep-begin" and
+			# "# go2make:keep-end" lines, and will be preserved.
+
+			load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+			go_binary(
+			    name = "c",
+			    srcs = [
+			        "main.go",
+			    ],
+			    visibility = ["//visibility:public"],
+			    deps = [
+			        "//p2",
+			    ],
+			)
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		tests:    true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+
+	check := func(wantOut string) {
+		t.Helper()
+		buf := bytes.Buffer{}
+		if err := emit.emitBazel(&buf, pkgMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want, got := strings.Trim(wantOut, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+			t.Errorf("wrong output:\n%s", cmp.Diff(want, got))
+		}
+		for name, want := range expect {
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(strings.TrimLeft(want, "\n"), string(got)); diff != "" {
+				t.Errorf("wrong %s:\n%s", name, diff)
+			}
+		}
+	}
+
+	// The first run writes all of the files, except the hand-written one.
+	check(dedent.Dedent(`
+		./cmd/c/BUILD.bazel
+		./p1/BUILD.bazel
+		./p2/BUILD.bazel
+	`))
+	if got, err := ioutil.ReadFile("p3/BUILD.bazel"); err != nil || string(got) != "# hand-written\n" {
+		t.Errorf("hand-written file was changed: %q, %v", got, err)
+	}
+
+	// The second run changes nothing.
+	check("")
+
+	// Edits outside of keep sections are lost, and keep sections are
+	// preserved.
+	f, err := os.OpenFile("p1/BUILD.bazel", os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "# lost\n\n# go2make:keep-begin\nfoo()\n# go2make:keep-end\n# lost\n")
+	f.Close()
+	expect["p1/BUILD.bazel"] += "\n# go2make:keep-begin\nfoo()\n# go2make:keep-end\n"
+	check("./p1/BUILD.bazel")
+	check("")
+}
+
+func TestBazelLabels(t *testing.T) {
+	testCases := []struct {
+		pkg    *packages.Package
+		expect string
+	}{{
+		pkg:    &packages.Package{PkgPath: "fmt", Name: "fmt"},
+		expect: "",
+	}, {
+		pkg: &packages.Package{
+			PkgPath: "github.com/foo/bar/baz",
+			Name:    "baz",
+			Module:  &packages.Module{Path: "github.com/foo/bar"},
+		},
+		expect: "@com_github_foo_bar//baz",
+	}, {
+		pkg: &packages.Package{
+			PkgPath: "golang.org/x/mod",
+			Name:    "mod",
+			Module:  &packages.Module{Path: "golang.org/x/mod"},
+		},
+		expect: "@org_golang_x_mod//:mod",
+	}, {
+		pkg: &packages.Package{
+			PkgPath: "example.com/Mod/v2/sub",
+			Name:    "sub",
+			Module:  &packages.Module{Path: "example.com/Mod/v2"},
+		},
+		expect: "@com_example_mod_v2//sub",
+	}, {
+		pkg: &packages.Package{
+			PkgPath: "example.com/mod/a/b",
+			Name:    "b",
+			Module:  &packages.Module{Path: "example.com/mod", Main: true},
+			GoFiles: []string{"/src/a/b/b.go"},
+		},
+		expect: "//a/b",
+	}, {
+		pkg: &packages.Package{
+			PkgPath: "example.com/mod",
+			Name:    "mod",
+			Module:  &packages.Module{Path: "example.com/mod", Main: true},
+			GoFiles: []string{"/src/mod.go"},
+		},
+		expect: "//:mod",
+	}}
+
+	emit := emitter{relPath: "/src"}
+	for _, tc := range testCases {
+		t.Run(tc.pkg.PkgPath, func(t *testing.T) {
+			if got := emit.bazelLabel(tc.pkg); got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestEmitDot(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "strings"
+			var V = strings.ToUpper("x")
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+		"p3/file3.go": dedent.Dedent(`
+			package p3
+			import (
+				"fmt"
+				"example.com/mod/p2"
+			)
+			var V = fmt.Sprint(p2.V)
+		`),
+	}
+	cases := []struct {
+		name        string
+		color       string
+		collapseStd bool
+		prune       []string
+		expect      string
+	}{{
+		name: "plain",
+		expect: dedent.Dedent(`
+			digraph go2make {
+			  node [shape=box];
+			  "fmt" [style="dashed"];
+			  "strings" [style="dashed"];
+
+			  subgraph "cluster_example.com/mod" {
+			    label = "example.com/mod";
+			    "example.com/mod/p1";
+			    "example.com/mod/p2";
+			    "example.com/mod/p3";
+			  }
+
+			  "example.com/mod/p1" -> "strings";
+			  "example.com/mod/p2" -> "example.com/mod/p1";
+			  "example.com/mod/p3" -> "example.com/mod/p2";
+			  "example.com/mod/p3" -> "fmt";
+			}
+		`),
+	}, {
+		name:        "collapse_std_color_root",
+		color:       "root",
+		collapseStd: true,
+		expect: dedent.Dedent(`
+			digraph go2make {
+			  node [shape=box];
+			  "std" [style="dashed"];
+
+			  subgraph "cluster_example.com/mod" {
+			    label = "example.com/mod";
+			    "example.com/mod/p1" [style="filled", fillcolor=lightblue];
+			    "example.com/mod/p2" [style="filled", fillcolor=lightblue];
+			    "example.com/mod/p3" [style="filled", fillcolor=lightblue];
+			  }
+
+			  "example.com/mod/p1" -> "std";
+			  "example.com/mod/p2" -> "example.com/mod/p1";
+			  "example.com/mod/p3" -> "example.com/mod/p2";
+			  "example.com/mod/p3" -> "std";
+			}
+		`),
+	}, {
+		name:        "prune_color_prune",
+		color:       "prune",
+		collapseStd: true,
+		prune:       []string{"example.com/mod/p1"},
+		expect: dedent.Dedent(`
+			digraph go2make {
+			  node [shape=box];
+			  "std" [style="dashed"];
+
+			  subgraph "cluster_example.com/mod" {
+			    label = "example.com/mod";
+			    "example.com/mod/p1" [style="dashed,filled", fillcolor=lightsalmon];
+			    "example.com/mod/p2";
+			    "example.com/mod/p3";
+			  }
+
+			  "example.com/mod/p2" -> "example.com/mod/p1";
+			  "example.com/mod/p3" -> "example.com/mod/p2";
+			  "example.com/mod/p3" -> "std";
+			}
+		`),
+	}}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			emit := emitter{
+				stateDir:         ".go2make",
+				relPath:          dir,
+				prune:            tc.prune,
+				graphColor:       tc.color,
+				graphCollapseStd: tc.collapseStd,
+			}
+			pkgMap := loadModule(t, emit, "./...")
+			buf := bytes.Buffer{}
+			emit.emitDot(&buf, pkgMap)
+			if want, got := strings.Trim(tc.expect, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+				t.Errorf("wrong result:\n%s", cmp.Diff(want, got))
+			}
+		})
+	}
+}
+
+func TestEmitMermaidAndGraphML(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "strings"
+			var V = strings.ToUpper("x")
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+	}
+	expectMermaid := dedent.Dedent(`
+		graph LR
+		  n2["std"]
+		  subgraph m1["example.com/mod"]
+		    n0["example.com/mod/p1"]
+		    n1["example.com/mod/p2"]
+		  end
+		  n0 --> n2
+		  n1 --> n0
+		  classDef boundary stroke-dasharray: 5 5
+		  class n2 boundary
+		  classDef root fill:lightblue
+		  class n0,n1 root
+	`)
+	expectGraphML := dedent.Dedent(`
+		<?xml version="1.0" encoding="UTF-8"?>
+		<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+		  <key id="module" for="node" attr.name="module" attr.type="string"/>
+		  <key id="version" for="node" attr.name="version" attr.type="string"/>
+		  <key id="files" for="node" attr.name="files" attr.type="int"/>
+		  <key id="dir" for="node" attr.name="dir" attr.type="string"/>
+		  <key id="boundary" for="node" attr.name="boundary" attr.type="boolean"/>
+		  <key id="color" for="node" attr.name="color" attr.type="string"/>
+		  <graph id="go2make" edgedefault="directed">
+		    <node id="example.com/mod/p1">
+		      <data key="module">example.com/mod</data>
+		      <data key="files">1</data>
+		      <data key="dir">./p1</data>
+		      <data key="boundary">false</data>
+		      <data key="color">lightblue</data>
+		    </node>
+		    <node id="example.com/mod/p2">
+		      <data key="module">example.com/mod</data>
+		      <data key="files">1</data>
+		      <data key="dir">./p2</data>
+		      <data key="boundary">false</data>
+		      <data key="color">lightblue</data>
+		    </node>
+		    <node id="std">
+		      <data key="boundary">true</data>
+		    </node>
+		    <edge source="example.com/mod/p1" target="std"/>
+		    <edge source="example.com/mod/p2" target="example.com/mod/p1"/>
+		  </graph>
+		</graphml>
+	`)
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir:         ".go2make",
+		relPath:          dir,
+		graphColor:       "root",
+		graphCollapseStd: true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+
+	buf := bytes.Buffer{}
+	emit.emitMermaid(&buf, pkgMap)
+	if want, got := strings.Trim(expectMermaid, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+		t.Errorf("wrong mermaid result:\n%s", cmp.Diff(want, got))
+	}
+
+	buf = bytes.Buffer{}
+	emit.emitGraphML(&buf, pkgMap)
+	if want, got := strings.Trim(expectGraphML, "\n"), strings.Trim(buf.String(), "\n"); want != got {
+		t.Errorf("wrong graphml result:\n%s", cmp.Diff(want, got))
+	}
+
+	// Packages which are not under --relative-to have no dir.
+	emit.relPath = dir + "/p2"
+	buf = bytes.Buffer{}
+	emit.emitGraphML(&buf, pkgMap)
+	if got := buf.String(); strings.Contains(got, dir) || !strings.Contains(got, `<data key="dir">.</data>`) {
+		t.Errorf("wrong graphml dirs:\n%s", got)
+	}
+}
+
+func TestGraphCollapseStd(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "strings"
+			import _ "example.com/mod/nope"
+			var V = strings.ToUpper("x")
+		`),
+	}
+
+	chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir:         ".go2make",
+		graphCollapseStd: true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	got := []string{}
+	for _, n := range emit.buildGraph(pkgMap).nodes {
+		got = append(got, n.id)
+	}
+	// The missing package has no module, but is not in the standard library.
+	expect := []string{"example.com/mod/nope", "example.com/mod/p1", "std"}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+}
+
+func TestEmitJSON(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "embed"
+			//go:embed data.txt
+			var F embed.FS
+		`),
+		"p1/data.txt": "",
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.F
+		`),
+		"p2/file2_test.go": dedent.Dedent(`
+			package p2
+			import "testing"
+			func TestV(t *testing.T) {}
+		`),
+		"p2/ext_test.go": dedent.Dedent(`
+			package p2_test
+			import "testing"
+			import "example.com/mod/p2"
+			func TestExt(t *testing.T) { _ = p2.V }
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+	mod := &jsonModule{Path: "example.com/mod", Dir: dir, Main: true}
+	expect := jsonOutput{
+		SchemaVersion: jsonSchemaVersion,
+		Packages: []jsonPackage{{
+			PkgPath: "example.com/mod/p1",
+			Name:    "p1",
+			Dir:     dir + "/p1",
+			RelDir:  "./p1",
+			Files: jsonFiles{
+				Go:       []string{dir + "/p1/file1.go"},
+				Compiled: []string{dir + "/p1/file1.go"},
+				Embed:    []string{dir + "/p1/data.txt"},
+			},
+			Imports: []string{"embed"},
+			Module:  mod,
+			Stamps: jsonStamps{
+				Files:  ".go2make/by-pkg/example.com/mod/p1/_files",
+				Pkg:    ".go2make/by-pkg/example.com/mod/p1/_pkg",
+				ByPath: ".go2make/by-path/./p1/_pkg",
+			},
+		}, {
+			PkgPath: "example.com/mod/p2",
+			Name:    "p2",
+			Dir:     dir + "/p2",
+			RelDir:  "./p2",
+			Files: jsonFiles{
+				Go:       []string{dir + "/p2/file2.go"},
+				Compiled: []string{dir + "/p2/file2.go"},
+				Test:     []string{dir + "/p2/ext_test.go", dir + "/p2/file2_test.go"},
+			},
+			Imports:     []string{"example.com/mod/p1"},
+			TestImports: []string{"testing"},
+			Module:      mod,
+			Stamps: jsonStamps{
+				Files:  ".go2make/by-pkg/example.com/mod/p2/_files",
+				Pkg:    ".go2make/by-pkg/example.com/mod/p2/_pkg",
+				ByPath: ".go2make/by-path/./p2/_pkg",
+				Test:   ".go2make/by-pkg/example.com/mod/p2/_test",
+			},
+		}, {
+			Kind:    "test",
+			ID:      "example.com/mod/p2 [example.com/mod/p2.test]",
+			PkgPath: "example.com/mod/p2",
+			Name:    "p2",
+			Dir:     dir + "/p2",
+			RelDir:  "./p2",
+			Files: jsonFiles{
+				Go:       []string{dir + "/p2/file2.go", dir + "/p2/file2_test.go"},
+				Compiled: []string{dir + "/p2/file2.go", dir + "/p2/file2_test.go"},
+			},
+			Imports: []string{"example.com/mod/p1", "testing"},
+			Module:  mod,
+			Stamps: jsonStamps{
+				Test: ".go2make/by-pkg/example.com/mod/p2/_test",
+			},
+		}, {
+			Kind:    "test",
+			ID:      "example.com/mod/p2_test [example.com/mod/p2.test]",
+			PkgPath: "example.com/mod/p2_test",
+			Name:    "p2_test",
+			Dir:     dir + "/p2",
+			RelDir:  "./p2",
+			Files: jsonFiles{
+				Go:       []string{dir + "/p2/ext_test.go"},
+				Compiled: []string{dir + "/p2/ext_test.go"},
+			},
+			Imports: []string{"example.com/mod/p2", "testing"},
+			Module:  mod,
+			Stamps: jsonStamps{
+				Test: ".go2make/by-pkg/example.com/mod/p2/_test",
+			},
+		}},
+	}
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		tests:    true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	buf := bytes.Buffer{}
+	if err := emit.emitJSON(&buf, pkgMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := jsonOutput{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("can't parse output: %v\n%s", err, buf.String())
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+	if !strings.HasPrefix(buf.String(), `{"schemaVersion":1,`) {
+		t.Errorf("schemaVersion is not first: %s", buf.String())
+	}
+}
+
+func TestEmitNDJSON(t *testing.T) {
+	files := map[string]string{
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			var V string
+		`),
+		"p3/file3.go": dedent.Dedent(`
+			package p3
+		`),
+		"p3/file3_test.go": dedent.Dedent(`
+			package p3
+			import "testing"
+			func TestV(t *testing.T) {}
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		goos:     "linux",
+		goarch:   "arm64",
+		tests:    true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	buf := bytes.Buffer{}
+	if err := emit.emitNDJSON(&buf, pkgMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	got := []string{}
+	for _, line := range lines {
+		rec := ndjsonRecord{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("can't parse line: %v\n%s", err, line)
+		}
+		if rec.SchemaVersion != jsonSchemaVersion || rec.GOOS != "linux" || rec.GOARCH != "arm64" {
+			t.Errorf("wrong record header: %s", line)
+		}
+		got = append(got, rec.Kind+":"+rec.PkgPath+":"+rec.Stamps.Test)
+	}
+	expect := []string{
+		":example.com/mod/p1:",
+		":example.com/mod/p2:",
+		":example.com/mod/p3:.go2make/by-pkg/example.com/mod/p3/_test",
+		"test:example.com/mod/p3:.go2make/by-pkg/example.com/mod/p3/_test",
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+}
+
+func TestEmitTemplate(t *testing.T) {
+	files := map[string]string{
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+		"p1/file 1.go": dedent.Dedent(`
+			package p1
+			var V string
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	tmplFile := filepath.Join(t.TempDir(), "test.tmpl")
+	tmplText := dedent.Dedent(`
+		# {{.GOOS}}/{{.GOARCH}}
+		{{- range topo .Packages}}
+		{{.PkgPath}}:{{range .Files.Go}} {{rel . | makeEscape}}{{end}}
+		{{- with pkg .PkgPath}} ({{.Name}}){{end}}
+		{{- end}}
+	`)
+	if err := ioutil.WriteFile(tmplFile, []byte(tmplText), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		goos:     "linux",
+		goarch:   "amd64",
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	tmpl, err := emit.loadTemplate(tmplFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := bytes.Buffer{}
+	if err := emit.emitTemplate(&buf, tmpl, pkgMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expect := dedent.Dedent(`
+		# linux/amd64
+		example.com/mod/p1: ./p1/file\ 1.go (p1)
+		example.com/mod/p2: ./p2/file2.go (p2)
+	`)
+	if diff := cmp.Diff(expect, buf.String()); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+}
+
+func TestTopoSort(t *testing.T) {
+	pkgs := []jsonPackage{
+		{PkgPath: "a", Imports: []string{"b", "c", "fmt"}},
+		{PkgPath: "b", Imports: []string{"c"}},
+		{PkgPath: "c"},
+		{PkgPath: "d", Imports: []string{"a"}},
+	}
+	got := []string{}
+	for _, pkg := range topoSort(pkgs) {
+		got = append(got, pkg.PkgPath)
+	}
+	expect := []string{"c", "b", "a", "d"}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+}
+
+func TestEmitSBOM(t *testing.T) {
+	files := map[string]string{
+		"go.mod": dedent.Dedent(`
+			module example.com/mod
+			go 1.18
+			require example.com/dep v1.0.0
+			replace example.com/dep => ./dep
+		`),
+		"cmd/app/main.go": dedent.Dedent(`
+			package main
+			import "example.com/mod/p1"
+			func main() { p1.F() }
+		`),
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "example.com/dep/d"
+			func F() { d.F() }
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+		`),
+		"dep/go.mod": dedent.Dedent(`
+			module example.com/dep
+			go 1.18
+		`),
+		"dep/d/d.go": dedent.Dedent(`
+			package d
+			import "fmt"
+			func F() { fmt.Println() }
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+	t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+		deps:     true,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+
+	t.Run("cyclonedx", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		if err := emit.emitCycloneDX(&buf, pkgMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bom := cdxBOM{}
+		if err := json.Unmarshal(buf.Bytes(), &bom); err != nil {
+			t.Fatalf("can't parse output: %v\n%s", err, buf.String())
+		}
+		expect := cdxBOM{
+			BOMFormat:   "CycloneDX",
+			SpecVersion: "1.4",
+			Version:     1,
+			Metadata: cdxMetadata{
+				Timestamp: "2001-09-09T01:46:40Z",
+				Tools:     []cdxTool{{Name: "go2make"}},
+				Component: cdxComponent{
+					BOMRef: "pkg:golang/example.com/mod#cmd/app",
+					Type:   "application",
+					Name:   "example.com/mod/cmd/app",
+					PURL:   "pkg:golang/example.com/mod#cmd/app",
+				},
+			},
+			Components: []cdxComponent{{
+				BOMRef:  "pkg:golang/example.com/dep@v1.0.0",
+				Type:    "library",
+				Name:    "example.com/dep",
+				Version: "v1.0.0",
+				PURL:    "pkg:golang/example.com/dep@v1.0.0",
+				Properties: []cdxProperty{
+					{"go2make:replace:path", "./dep"},
+					{"go2make:replace:dir", filepath.Join(dir, "dep")},
+				},
+			}},
+			Dependencies: []cdxDependency{
+				{Ref: "pkg:golang/example.com/mod#cmd/app", DependsOn: []string{"pkg:golang/example.com/dep@v1.0.0"}},
+				{Ref: "pkg:golang/example.com/dep@v1.0.0", DependsOn: []string{}},
+			},
+		}
+		if diff := cmp.Diff(expect, bom); diff != "" {
+			t.Errorf("wrong result:\n%s", diff)
+		}
+	})
+
+	t.Run("spdx", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		if err := emit.emitSPDX(&buf, pkgMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		doc := spdxDocument{}
+		if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+			t.Fatalf("can't parse output: %v\n%s", err, buf.String())
+		}
+		if !strings.HasPrefix(doc.DocumentNamespace, "https://spdx.org/spdxdocs/go2make/example.com/mod/cmd/app-") {
+			t.Errorf("wrong namespace: %q", doc.DocumentNamespace)
+		}
+		doc.DocumentNamespace = ""
+		expect := spdxDocument{
+			SPDXVersion: "SPDX-2.3",
+			DataLicense: "CC0-1.0",
+			SPDXID:      "SPDXRef-DOCUMENT",
+			Name:        "example.com/mod/cmd/app",
+			CreationInfo: spdxCreationInfo{
+				Created:  "2001-09-09T01:46:40Z",
+				Creators: []string{"Tool: go2make"},
+			},
+			Packages: []spdxPackage{{
+				Name:             "example.com/mod/cmd/app",
+				SPDXID:           "SPDXRef-Package-example.com-mod-cmd-app",
+				DownloadLocation: "NOASSERTION",
+				ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", "pkg:golang/example.com/mod#cmd/app"}},
+			}, {
+				Name:             "example.com/dep",
+				SPDXID:           "SPDXRef-Package-example.com-dep",
+				VersionInfo:      "v1.0.0",
+				DownloadLocation: "NOASSERTION",
+				ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", "pkg:golang/example.com/dep@v1.0.0"}},
+				Comment:          "replaced by " + filepath.Join(dir, "dep"),
+			}},
+			Relationships: []spdxRelationship{
+				{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package-example.com-mod-cmd-app"},
+				{"SPDXRef-Package-example.com-mod-cmd-app", "DEPENDS_ON", "SPDXRef-Package-example.com-dep"},
+			},
+		}
+		if diff := cmp.Diff(expect, doc); diff != "" {
+			t.Errorf("wrong result:\n%s", diff)
+		}
+	})
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("GOPROXY", "")
+	has := func(env []string, kv string) bool {
+		for _, s := range env {
+			if s == kv {
+				return true
+			}
+		}
+		return false
+	}
+
+	cfg := emitter{}.loadConfig()
+	if has(cfg.Env, "GOPROXY=off") {
+		t.Errorf("unexpected GOPROXY=off without deps")
+	}
+	cfg = emitter{deps: true, goos: "linux", goarch: "arm64"}.loadConfig()
+	for _, kv := range []string{"GOPROXY=off", "GOOS=linux", "GOARCH=arm64"} {
+		if !has(cfg.Env, kv) {
+			t.Errorf("missing %s in env", kv)
+		}
+	}
+}
+
+func TestModuleSum(t *testing.T) {
+	modCache := t.TempDir()
+	writeFile(t, modCache, "cache/download/example.com/!big/@v/v1.0.0.ziphash", "h1:fromcache=\n")
+	emit := emitter{modCache: modCache}
+	sums := map[string]string{
+		"example.com/a@v1.0.0": "h1:a=",
+		"example.com/b@v2.0.0": "h1:b=",
+	}
+
+	testCases := []struct {
+		name   string
+		mod    packages.Module
+		expect string
+	}{{
+		name:   "in go.sum",
+		mod:    packages.Module{Path: "example.com/a", Version: "v1.0.0"},
+		expect: "h1:a=",
+	}, {
+		name:   "replaced",
+		mod:    packages.Module{Path: "example.com/a", Version: "v1.0.0", Replace: &packages.Module{Path: "example.com/b", Version: "v2.0.0"}},
+		expect: "h1:b=",
+	}, {
+		name:   "replaced by dir",
+		mod:    packages.Module{Path: "example.com/a", Version: "v1.0.0", Replace: &packages.Module{Path: "../a", Dir: "/src/a"}},
+		expect: "",
+	}, {
+		name:   "in module cache",
+		mod:    packages.Module{Path: "example.com/Big", Version: "v1.0.0"},
+		expect: "h1:fromcache=",
+	}, {
+		name:   "unknown",
+		mod:    packages.Module{Path: "example.com/c", Version: "v1.0.0"},
+		expect: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := emit.moduleSum(&tc.mod, sums); got != tc.expect {
+				t.Errorf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestLoadAndEmit(t *testing.T) {
+	files := map[string]string{
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/p1"
+			var V = p1.V
+		`),
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			var V string
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+	graph, err := Load(opts, "./...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("variants", func(t *testing.T) {
+		variants := graph.Variants()
+		if len(variants) != 1 {
+			t.Fatalf("expected 1 variant, got %d", len(variants))
+		}
+		got := []string{}
+		for k := range variants[0].Packages {
+			got = append(got, k)
+		}
+		sort.Strings(got)
+		expect := []string{"example.com/mod/p1", "example.com/mod/p2"}
+		if diff := cmp.Diff(expect, got); diff != "" {
+			t.Errorf("wrong result:\n%s", diff)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		var e Emitter = EmitterFunc(func(out io.Writer, g *Graph) error {
+			for _, v := range g.Variants() {
+				fmt.Fprintln(out, len(v.Packages), v.StateDir)
+			}
+			return nil
+		})
+		buf := bytes.Buffer{}
+		if err := e.Emit(&buf, graph); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, expect := buf.String(), "2 .go2make\n"; got != expect {
+			t.Errorf("expected %q, got %q", expect, got)
+		}
+	})
+
+	t.Run("builtin", func(t *testing.T) {
+		for _, format := range Formats() {
+			e, err := NewEmitter(format)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// These need options which were not set, or write files.
+			switch format {
+			case "bazel", "compile", "cyclonedx", "spdx":
+				continue
+			}
+			buf := bytes.Buffer{}
+			if err := e.Emit(&buf, graph); err != nil {
+				t.Errorf("%s: unexpected error: %v", format, err)
+			}
+			if buf.Len() == 0 {
+				t.Errorf("%s: no output", format)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := NewEmitter("nope"); err == nil {
+			t.Errorf("expected an error for an unknown format")
+		}
+		for _, format := range []string{"compile", "cyclonedx"} {
+			e, _ := NewEmitter(format)
+			if err := e.Emit(io.Discard, graph); err == nil {
+				t.Errorf("%s: expected an error for missing options", format)
+			}
+		}
+		bad := opts
+		bad.StampMode = "nope"
+		if _, err := Load(bad, "./..."); err == nil {
+			t.Errorf("expected an error for a bad stamp mode")
+		}
+		bad = opts
+		bad.Platforms = []string{"linux"}
+		if _, err := Load(bad, "./..."); err == nil {
+			t.Errorf("expected an error for a bad platform")
+		}
+	})
+
+	t.Run("variants-unsupported", func(t *testing.T) {
+		multi := opts
+		multi.Platforms = []string{"linux/amd64"}
+		graph, err := Load(multi, "./...")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		e, _ := NewEmitter("dot")
+		if err := e.Emit(io.Discard, graph); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+// failWriter fails every write.
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk full")
+}
+
+func TestErrors(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "example.com/mod/nope"
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+
+	t.Run("package", func(t *testing.T) {
+		opts := opts
+		opts.Imports = true
+		_, err := Load(opts, "./...")
+		var perrs PackageErrors
+		if !errors.As(err, &perrs) {
+			t.Fatalf("expected PackageErrors, got %T: %v", err, err)
+		}
+		if len(perrs) != 1 {
+			t.Fatalf("expected 1 error, got %d: %v", len(perrs), perrs)
+		}
+		if pe := perrs[0]; pe.PkgPath != "example.com/mod/nope" || pe.Pos != "p1/file1.go:3:8" || pe.File != "p1/file1.go" || pe.Line != 3 || pe.Column != 8 {
+			t.Errorf("wrong error: %#v", pe)
+		}
+
+		opts.IgnoreErrors = true
+		if _, err := Load(opts, "./..."); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		testCases := []struct {
+			name  string
+			kinds []string
+			in    []string
+			fail  bool
+		}{
+			{name: "kind", kinds: []string{"list"}},
+			{name: "other kind", kinds: []string{"type", "parse"}, fail: true},
+			{name: "prefix", in: []string{"example.com/mod/nope/"}},
+			{name: "importer prefix", in: []string{"example.com/mod/p1"}},
+			{name: "other prefix", in: []string{"example.com/mod/p2"}, fail: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				opts := opts
+				opts.Imports = true
+				opts.IgnoreErrorKinds = tc.kinds
+				opts.IgnoreErrorsIn = tc.in
+				graph, err := Load(opts, "./...")
+				if tc.fail {
+					var perrs PackageErrors
+					if !errors.As(err, &perrs) {
+						t.Fatalf("expected PackageErrors, got %T: %v", err, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				ignored := graph.IgnoredErrors()
+				if len(ignored) != 1 || ignored[0].PkgPath != "example.com/mod/nope" {
+					t.Errorf("wrong ignored errors: %v", ignored)
+				}
+			})
+		}
+
+		bad := opts
+		bad.IgnoreErrorKinds = []string{"bogus"}
+		if _, err := Load(bad, "./..."); err == nil {
+			t.Errorf("expected an error for a bad kind")
+		}
+	})
+
+	t.Run("load", func(t *testing.T) {
+		t.Setenv("GOFLAGS", "-bogus")
+		_, err := Load(opts, "./...")
+		var lerr *LoadError
+		if !errors.As(err, &lerr) {
+			t.Fatalf("expected LoadError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("emit", func(t *testing.T) {
+		graph, err := Load(opts, "./p2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		e, err := NewEmitter("make")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = e.Emit(failWriter{}, graph)
+		var eerr *EmitError
+		if !errors.As(err, &eerr) {
+			t.Fatalf("expected EmitError, got %T: %v", err, err)
+		}
+		if eerr.Format != "make" {
+			t.Errorf("wrong format: %q", eerr.Format)
+		}
+	})
+}
+
+func TestErrorsIgnoredOnFailure(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			import "example.com/mod/nope"
+			var X = nope.X
+		`),
+		"p2/file2.go": dedent.Dedent(`
+			package p2
+			import "example.com/mod/gone"
+			var X = gone.X
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+	opts.Imports = true
+	opts.IgnoreErrorsIn = []string{"example.com/mod/p1"}
+	graph, err := Load(opts, "./...")
+	var perrs PackageErrors
+	if !errors.As(err, &perrs) {
+		t.Fatalf("expected PackageErrors, got %T: %v", err, err)
+	}
+	if len(perrs) != 1 || perrs[0].PkgPath != "example.com/mod/gone" {
+		t.Errorf("wrong errors: %v", perrs)
+	}
+	if graph == nil {
+		t.Fatalf("expected a graph with the ignored errors")
+	}
+	if ignored := graph.IgnoredErrors(); len(ignored) != 1 || ignored[0].PkgPath != "example.com/mod/nope" {
+		t.Errorf("wrong ignored errors: %v", ignored)
+	}
+}
+
+func TestParsePos(t *testing.T) {
+	testCases := []struct {
+		pos  string
+		file string
+		line int
+		col  int
+	}{
+		{"", "", 0, 0},
+		{"a/b.go", "a/b.go", 0, 0},
+		{"a/b.go:12", "a/b.go", 12, 0},
+		{"a/b.go:12:3", "a/b.go", 12, 3},
+		{"c:/a/b.go:12:3", "c:/a/b.go", 12, 3},
+		{"a:b.go:x", "a:b.go:x", 0, 0},
+	}
+	for _, tc := range testCases {
+		file, line, col := parsePos(tc.pos)
+		if file != tc.file || line != tc.line || col != tc.col {
+			t.Errorf("%q: expected %q %d %d, got %q %d %d", tc.pos, tc.file, tc.line, tc.col, file, line, col)
+		}
+	}
+}
+
+func TestGoGeneratesTestFiles(t *testing.T) {
+	files := map[string]string{
+		"p1/file1.go": dedent.Dedent(`
+			package p1
+			//go:generate echo file1
+		`),
+		"p1/file1_test.go": dedent.Dedent(`
+			package p1
+			//go:generate echo test
+		`),
+		"p1/ext_test.go": dedent.Dedent(`
+			package p1_test
+			//go:generate echo ext
+		`),
+		"p1/tagged_test.go": dedent.Dedent(`
+			//go:build sometag
+			package p1
+			//go:generate echo tagged
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	emit := emitter{
+		stateDir: ".go2make",
+		relPath:  dir,
+	}
+
+	pkgMap := loadModule(t, emit, "./...")
+	got := []string{}
+	for _, d := range emit.goGenerates(pkgMap["example.com/mod/p1"]) {
+		got = append(got, filepath.Base(d.file)+": "+strings.Join(d.args, " "))
+	}
+	expect := []string{"file1.go: echo file1", "ext_test.go: echo ext", "file1_test.go: echo test"}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("wrong result:\n%s", diff)
+	}
+}
+
+func TestGoRunPackage(t *testing.T) {
+	testCases := []struct {
+		args   string
+		expect string
+	}{
+		{"./gen", "./gen"},
+		{"./gen -in x", "./gen"},
+		{"-tags x ./gen", "./gen"},
+		{"-tags=x ./gen", "./gen"},
+		{"--tags x ./gen", "./gen"},
+		{"-race -mod mod -ldflags -s ./gen", "./gen"},
+		{"-v -- ./gen", "./gen"},
+		{"-tags", ""},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if got := goRunPackage(strings.Fields(tc.args)); got != tc.expect {
+			t.Errorf("%q: expected %q, got %q", tc.args, tc.expect, got)
+		}
+	}
+}
+
+func TestWriteErrorsJSON(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		ignored PackageErrors
+		expect  string
+	}{{
+		name: "package",
+		err: PackageErrors{
+			newPackageError(&packages.Package{PkgPath: "example.com/a"}, packages.Error{Pos: "a/a.go:3:8", Msg: "bad import", Kind: packages.ListError}),
+			newPackageError(&packages.Package{PkgPath: "example.com/b"}, packages.Error{Pos: "-", Msg: "oops"}),
+		},
+		expect: `{"errors":[{"kind":"list","pkgPath":"example.com/a","file":"a/a.go","line":3,"column":8,"msg":"bad import"},{"kind":"unknown","pkgPath":"example.com/b","msg":"oops"}]}` + "\n",
+	}, {
+		name:   "load",
+		err:    &LoadError{Err: fmt.Errorf("no go")},
+		expect: `{"errors":[{"kind":"load","msg":"no go"}]}` + "\n",
+	}, {
+		name:   "emit",
+		err:    &EmitError{Format: "json", Err: fmt.Errorf("disk full")},
+		expect: `{"errors":[{"kind":"output","msg":"emitting json: disk full"}]}` + "\n",
+	}, {
+		name:   "other",
+		err:    fmt.Errorf("bad option"),
+		expect: `{"errors":[{"kind":"other","msg":"bad option"}]}` + "\n",
+	}, {
+		name:    "ignored",
+		ignored: PackageErrors{newPackageError(&packages.Package{PkgPath: "example.com/a"}, packages.Error{Msg: "meh", Kind: packages.TypeError})},
+		expect:  `{"errors":[{"kind":"type","pkgPath":"example.com/a","msg":"meh","ignored":true}]}` + "\n",
+	}, {
+		name:   "none",
+		expect: `{"errors":[]}` + "\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			if err := WriteErrorsJSON(&buf, tc.err, tc.ignored); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.expect, buf.String()); diff != "" {
+				t.Errorf("wrong result:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEmitMakePartial(t *testing.T) {
+	files := map[string]string{
+		"good/good.go": dedent.Dedent(`
+			package good
+		`),
+		"bad/bad.go": dedent.Dedent(`
+			package bad
+			import "example.com/mod/nope"
+			var X = nope.X
+		`),
+		"user/user.go": dedent.Dedent(`
+			package user
+			import _ "example.com/mod/bad"
+		`),
+		"cmd/ok/main.go": dedent.Dedent(`
+			package main
+			import _ "example.com/mod/good"
+			func main() {}
+		`),
+		"cmd/broken/main.go": dedent.Dedent(`
+			package main
+			import _ "example.com/mod/user"
+			func main() {}
+		`),
+	}
+
+	dir := chdirModule(t, "example.com/mod", files)
+
+	opts := DefaultOptions()
+	opts.RelativeTo = dir
+	opts.Imports = true
+	opts.Partial = true
+	graph, err := Load(opts, "./...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if broken := graph.BrokenErrors(); len(broken) != 1 || broken[0].PkgPath != "example.com/mod/nope" {
+		t.Errorf("wrong broken errors: %v", broken)
+	}
+
+	e, err := NewEmitter("make")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := bytes.Buffer{}
+	if err := e.Emit(&buf, graph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expect := dedent.Dedent(`
+		.go2make/by-pkg/example.com/mod/nope/_pkg: .go2make/_force
+			@rm -f $@
+			@echo 'go2make: package example.com/mod/nope has errors:' >&2
+			@echo '    bad/bad.go:3:8: no required module provides package example.com/mod/nope; to add it:' >&2
+			@echo '    	go get example.com/mod/nope' >&2
+			@false
+	`)
+	if !strings.Contains(buf.String(), expect) {
+		t.Errorf("missing failing rule:\n%s", buf.String())
+	}
+	for _, pkg := range []string{"good", "bad", "user"} {
+		if !strings.Contains(buf.String(), ".go2make/by-pkg/example.com/mod/"+pkg+"/_pkg: ") {
+			t.Errorf("missing rule for %s", pkg)
+		}
+	}
+
+	// Binaries which depend on broken packages still have rules, which
+	// fail.
+	opts.Compile = true
+	graph, err = Load(opts, "./...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e, _ = NewEmitter("compile")
+	buf.Reset()
+	if err := e.Emit(&buf, graph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, rule := range []string{
+		"$(GO2MAKE_BIN_DIR)/ok: .go2make/by-pkg/example.com/mod/cmd/ok/_pkg.a ",
+		"$(GO2MAKE_BIN_DIR)/broken: .go2make/by-pkg/example.com/mod/cmd/broken/_pkg\n",
+	} {
+		if !strings.Contains(buf.String(), rule) {
+			t.Errorf("missing rule %q:\n%s", rule, buf.String())
+		}
+	}
+
+	e, _ = NewEmitter("json")
+	if err := e.Emit(io.Discard, graph); err == nil {
+		t.Errorf("expected an error for json with partial")
+	}
+}
+
+func TestMakeShellQuote(t *testing.T) {
+	testCases := []struct {
+		in     string
+		expect string
+	}{
+		{"plain", `'plain'`},
+		{"it's", `'it'\''s'`},
+		{"$HOME", `'$$HOME'`},
+	}
+	for _, tc := range testCases {
+		if got := makeShellQuote(tc.in); got != tc.expect {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.expect, got)
+		}
+	}
+}
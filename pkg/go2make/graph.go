@@ -0,0 +1,313 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// stdNode is the ID of the node which represents the whole standard library
+// when it is collapsed.
+const stdNode = "std"
+
+// graph is a package dependency graph, as rendered by the graph outputs.
+type graph struct {
+	nodes []*graphNode // sorted by ID
+	edges [][2]string  // from, to; sorted
+}
+
+// graphNode is a single package (or the collapsed standard library).
+type graphNode struct {
+	id       string
+	pkg      *packages.Package // nil for the collapsed standard library
+	boundary bool              // imported, but not processed
+	color    string            // "" for no color
+}
+
+// module returns the path of the node's module, or "" if it has none (e.g.
+// the standard library).
+func (n *graphNode) module() string {
+	if n.pkg == nil || n.pkg.Module == nil {
+		return ""
+	}
+	return n.pkg.Module.Path
+}
+
+// isStd returns true if pkg is in the standard library.  Packages which
+// could not be found have no module either, so this also requires that pkg
+// has no errors and that its path does not start with a domain name.
+func isStd(pkg *packages.Package) bool {
+	first := strings.SplitN(pkg.PkgPath, "/", 2)[0]
+	return pkg.Module == nil && len(pkg.Errors) == 0 && !strings.Contains(first, ".")
+}
+
+// Colors used by --graph-color.
+const (
+	rootColor  = "lightblue"
+	pruneColor = "lightsalmon"
+)
+
+// buildGraph builds the dependency graph of the packages in pkgMap.  Imports
+// which are not in pkgMap (e.g. because they are not under --root, are
+// pruned or --imports was not specified) are included as boundary nodes,
+// but their own imports are not.
+func (emit emitter) buildGraph(pkgMap map[string]*packages.Package) *graph {
+	nodes := map[string]*graphNode{}
+	edges := map[[2]string]bool{}
+
+	nodeFor := func(pkg *packages.Package) string {
+		id := pkg.PkgPath
+		if emit.graphCollapseStd && isStd(pkg) {
+			id = stdNode
+			pkg = nil
+		}
+		if nodes[id] == nil {
+			nodes[id] = &graphNode{id: id, pkg: pkg, boundary: true}
+		}
+		return id
+	}
+
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if isTestNode(pkg) {
+			return
+		}
+		from := nodeFor(pkg)
+		nodes[from].boundary = false
+		for _, imp := range pkg.Imports {
+			if to := nodeFor(imp); to != from {
+				edges[[2]string{from, to}] = true
+			}
+		}
+	})
+
+	g := &graph{}
+	for _, n := range nodes {
+		switch {
+		case emit.graphColor == "root" && !n.boundary && (len(emit.roots) == 0 || rooted(n.id, emit.roots)):
+			n.color = rootColor
+		case emit.graphColor == "prune" && len(emit.prune) > 0 && rooted(n.id, emit.prune):
+			n.color = pruneColor
+		}
+		g.nodes = append(g.nodes, n)
+	}
+	sort.Slice(g.nodes, func(i, j int) bool { return g.nodes[i].id < g.nodes[j].id })
+	for e := range edges {
+		g.edges = append(g.edges, e)
+	}
+	sort.Slice(g.edges, func(i, j int) bool {
+		if g.edges[i][0] != g.edges[j][0] {
+			return g.edges[i][0] < g.edges[j][0]
+		}
+		return g.edges[i][1] < g.edges[j][1]
+	})
+	return g
+}
+
+// byModule groups the graph's nodes by module path, in order.  Nodes with no
+// module are under "".
+func (g *graph) byModule() ([]string, map[string][]*graphNode) {
+	mods := []string{}
+	byMod := map[string][]*graphNode{}
+	for _, n := range g.nodes {
+		m := n.module()
+		if byMod[m] == nil {
+			mods = append(mods, m)
+		}
+		byMod[m] = append(byMod[m], n)
+	}
+	sort.Strings(mods)
+	return mods, byMod
+}
+
+// emitDot emits the dependency graph in Graphviz DOT format, with a cluster
+// for each module.
+func (emit emitter) emitDot(out io.Writer, pkgMap map[string]*packages.Package) {
+	g := emit.buildGraph(pkgMap)
+
+	fmt.Fprintf(out, "digraph go2make {\n")
+	fmt.Fprintf(out, "  node [shape=box];\n")
+	mods, byMod := g.byModule()
+	for _, m := range mods {
+		indent := "  "
+		if m != "" {
+			fmt.Fprintf(out, "\n")
+			fmt.Fprintf(out, "  subgraph %s {\n", dotQuote("cluster_"+m))
+			fmt.Fprintf(out, "    label = %s;\n", dotQuote(m))
+			indent = "    "
+		}
+		for _, n := range byMod[m] {
+			styles := []string{}
+			if n.boundary {
+				styles = append(styles, "dashed")
+			}
+			if n.color != "" {
+				styles = append(styles, "filled")
+			}
+			attrs := []string{}
+			if len(styles) > 0 {
+				attrs = append(attrs, "style="+dotQuote(strings.Join(styles, ",")))
+			}
+			if n.color != "" {
+				attrs = append(attrs, "fillcolor="+n.color)
+			}
+			if len(attrs) > 0 {
+				fmt.Fprintf(out, "%s%s [%s];\n", indent, dotQuote(n.id), strings.Join(attrs, ", "))
+			} else {
+				fmt.Fprintf(out, "%s%s;\n", indent, dotQuote(n.id))
+			}
+		}
+		if m != "" {
+			fmt.Fprintf(out, "  }\n")
+		}
+	}
+	if len(g.edges) > 0 {
+		fmt.Fprintf(out, "\n")
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(out, "  %s -> %s;\n", dotQuote(e[0]), dotQuote(e[1]))
+	}
+	fmt.Fprintf(out, "}\n")
+}
+
+// dotQuote returns s as a DOT quoted string.
+func dotQuote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// emitMermaid emits the dependency graph as a Mermaid flowchart, with a
+// subgraph for each module.
+func (emit emitter) emitMermaid(out io.Writer, pkgMap map[string]*packages.Package) {
+	g := emit.buildGraph(pkgMap)
+
+	// Mermaid IDs can't have most punctuation, so nodes are numbered.
+	ids := map[string]string{}
+	for i, n := range g.nodes {
+		ids[n.id] = fmt.Sprintf("n%d", i)
+	}
+
+	fmt.Fprintf(out, "graph LR\n")
+	mods, byMod := g.byModule()
+	classes := map[string][]string{}
+	for i, m := range mods {
+		indent := "  "
+		if m != "" {
+			fmt.Fprintf(out, "  subgraph m%d[%s]\n", i, mermaidQuote(m))
+			indent = "    "
+		}
+		for _, n := range byMod[m] {
+			fmt.Fprintf(out, "%s%s[%s]\n", indent, ids[n.id], mermaidQuote(n.id))
+			if n.boundary {
+				classes["boundary"] = append(classes["boundary"], ids[n.id])
+			}
+			switch n.color {
+			case rootColor:
+				classes["root"] = append(classes["root"], ids[n.id])
+			case pruneColor:
+				classes["prune"] = append(classes["prune"], ids[n.id])
+			}
+		}
+		if m != "" {
+			fmt.Fprintf(out, "  end\n")
+		}
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(out, "  %s --> %s\n", ids[e[0]], ids[e[1]])
+	}
+	classDefs := []struct{ name, style string }{
+		{"boundary", "stroke-dasharray: 5 5"},
+		{"root", "fill:" + rootColor},
+		{"prune", "fill:" + pruneColor},
+	}
+	for _, cd := range classDefs {
+		if len(classes[cd.name]) > 0 {
+			fmt.Fprintf(out, "  classDef %s %s\n", cd.name, cd.style)
+			fmt.Fprintf(out, "  class %s %s\n", strings.Join(classes[cd.name], ","), cd.name)
+		}
+	}
+}
+
+// mermaidQuote returns s as a Mermaid quoted label.
+func mermaidQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+}
+
+// emitGraphML emits the dependency graph as GraphML, with attributes on each
+// node for analysis in other tools.
+func (emit emitter) emitGraphML(out io.Writer, pkgMap map[string]*packages.Package) {
+	g := emit.buildGraph(pkgMap)
+
+	attrs := []struct{ id, typ string }{
+		{"module", "string"},
+		{"version", "string"},
+		{"files", "int"},
+		{"dir", "string"},
+		{"boundary", "boolean"},
+		{"color", "string"},
+	}
+	fmt.Fprintf(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(out, "<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	for _, k := range attrs {
+		fmt.Fprintf(out, "  <key id=%q for=\"node\" attr.name=%q attr.type=%q/>\n", k.id, k.id, k.typ)
+	}
+	fmt.Fprintf(out, "  <graph id=\"go2make\" edgedefault=\"directed\">\n")
+	for _, n := range g.nodes {
+		data := map[string]string{
+			"boundary": fmt.Sprint(n.boundary),
+			"color":    n.color,
+		}
+		if n.pkg != nil {
+			if n.pkg.Module != nil {
+				data["module"] = n.pkg.Module.Path
+				data["version"] = n.pkg.Module.Version
+			}
+			data["files"] = fmt.Sprint(len(n.pkg.GoFiles))
+			if len(n.pkg.GoFiles) > 0 {
+				// Like relDir in the JSON output, this is only set for
+				// packages under --relative-to.
+				if rel, isRel := maybeRelative(filepath.Dir(n.pkg.GoFiles[0]), emit.relPath); isRel {
+					data["dir"] = rel
+				}
+			}
+		}
+		fmt.Fprintf(out, "    <node id=\"%s\">\n", xmlEscape(n.id))
+		for _, k := range attrs {
+			if v := data[k.id]; v != "" {
+				fmt.Fprintf(out, "      <data key=%q>%s</data>\n", k.id, xmlEscape(v))
+			}
+		}
+		fmt.Fprintf(out, "    </node>\n")
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(out, "    <edge source=\"%s\" target=\"%s\"/>\n", xmlEscape(e[0]), xmlEscape(e[1]))
+	}
+	fmt.Fprintf(out, "  </graph>\n")
+	fmt.Fprintf(out, "</graphml>\n")
+}
+
+// xmlEscape escapes s for use in XML text or attribute values.
+func xmlEscape(s string) string {
+	buf := strings.Builder{}
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bufio"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// includeRE matches quoted C-style includes, which are the only ones that
+// might refer to files in the repo.  Angle-bracket includes are assumed to be
+// system headers.
+var includeRE = regexp.MustCompile(`^\s*#\s*include\s*"([^"]+)"`)
+
+// cgoFlagsRE matches cgo directives which can carry -I flags.
+var cgoFlagsRE = regexp.MustCompile(`^\s*#cgo\s+(?:[^:]*\s)?(?:CFLAGS|CPPFLAGS|CXXFLAGS):(.*)$`)
+
+// includesOf returns the cIncludes of pkg, which are scanned once, when pkg is
+// visited.
+func (emit emitter) includesOf(pkg *packages.Package) []string {
+	if incs, found := emit.includes[pkg]; found {
+		return incs
+	}
+	return emit.cIncludes(pkg)
+}
+
+// cIncludes finds the headers which are #included by pkg's cgo preambles
+// and non-Go sources (e.g. .c, .h and .s files), recursively, and which live
+// under includeRoot.  This is a very small version of what a C compiler does
+// when it writes a depfile - it does not evaluate the preprocessor, so it may
+// find more headers than are really used, but never fewer.
+func (emit emitter) cIncludes(pkg *packages.Package) []string {
+	// Only scan code in the main module(s).  Everything else is either
+	// immutable (the module cache) or unknown (GOROOT).
+	if pkg.Module == nil || !pkg.Module.Main || pkg.Module.Dir == "" || len(pkg.GoFiles) == 0 {
+		return nil
+	}
+	root := emit.includeRoot(pkg)
+	pkgDir := filepath.Dir(pkg.GoFiles[0])
+
+	preambles := []string{}
+	dirs := []string{}
+	for _, f := range pkg.GoFiles {
+		if preamble := cgoPreamble(f); preamble != "" {
+			preambles = append(preambles, preamble)
+			dirs = append(dirs, cgoIncludeDirs(pkgDir, preamble)...)
+		}
+	}
+
+	// Includes are relative to the including file's dir first, then to
+	// the -I dirs.
+	found := map[string]bool{}
+	todo := []string{}
+	resolve := func(from string, names []string) {
+		for _, name := range names {
+			p := resolveInclude(name, append([]string{from}, dirs...), root)
+			if p != "" && !found[p] {
+				found[p] = true
+				todo = append(todo, p)
+			}
+		}
+	}
+
+	for _, preamble := range preambles {
+		resolve(pkgDir, scanIncludes(strings.NewReader(preamble)))
+	}
+	for _, f := range pkg.OtherFiles {
+		if isCSource(f) {
+			todo = append(todo, f)
+		}
+	}
+	scanned := map[string]bool{}
+	for len(todo) > 0 {
+		f := todo[0]
+		todo = todo[1:]
+		if scanned[f] {
+			continue
+		}
+		scanned[f] = true
+		file, err := os.Open(f)
+		if err != nil {
+			emit.debug("    can't scan", f, "for includes:", err)
+			continue
+		}
+		resolve(filepath.Dir(f), scanIncludes(file))
+		file.Close()
+	}
+
+	out := make([]string, 0, len(found))
+	for f := range found {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// includeRoot returns the dir under which pkg's headers must live: the
+// outermost of pkg's module, the go.work dir (if there is one) and
+// --relative-to which holds the module.  This allows headers shared
+// between the modules of a workspace or repo, but not system headers.
+func (emit emitter) includeRoot(pkg *packages.Package) string {
+	root := filepath.Clean(pkg.Module.Dir)
+	candidates := []string{emit.relPath}
+	if emit.goWork != "" && emit.goWork != "off" {
+		candidates = append(candidates, filepath.Dir(emit.goWork))
+	}
+	for _, dir := range candidates {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if len(dir) < len(root) && strings.HasPrefix(root, dir+"/") {
+			root = dir
+		}
+	}
+	return root
+}
+
+// cgoPreamble returns the comment which precedes `import "C"` in the named
+// file, or "" if there is none.  This follows the same rules as cgo.
+func cgoPreamble(filename string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return ""
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			is := spec.(*ast.ImportSpec)
+			if is.Path.Value != `"C"` {
+				continue
+			}
+			if is.Doc != nil {
+				return is.Doc.Text()
+			}
+			if len(gd.Specs) == 1 && gd.Doc != nil {
+				return gd.Doc.Text()
+			}
+		}
+	}
+	return ""
+}
+
+// cgoIncludeDirs returns the -I dirs named in the #cgo directives of a
+// preamble.
+func cgoIncludeDirs(pkgDir, preamble string) []string {
+	dirs := []string{}
+	for _, line := range strings.Split(preamble, "\n") {
+		m := cgoFlagsRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		args := strings.Fields(strings.ReplaceAll(m[1], "${SRCDIR}", pkgDir))
+		for i := 0; i < len(args); i++ {
+			dir := ""
+			if args[i] == "-I" && i+1 < len(args) {
+				i++
+				dir = args[i]
+			} else if strings.HasPrefix(args[i], "-I") {
+				dir = strings.TrimPrefix(args[i], "-I")
+			}
+			if dir == "" {
+				continue
+			}
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(pkgDir, dir)
+			}
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	return dirs
+}
+
+// scanIncludes returns the quoted #include names in a C-like source.
+func scanIncludes(r io.Reader) []string {
+	incs := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if m := includeRE.FindStringSubmatch(scanner.Text()); m != nil {
+			incs = append(incs, m[1])
+		}
+	}
+	return incs
+}
+
+// resolveInclude finds the named include in one of dirs, and returns its
+// absolute path if it exists and is under root.
+func resolveInclude(name string, dirs []string, root string) string {
+	if filepath.IsAbs(name) {
+		dirs = []string{"/"}
+	}
+	for _, dir := range dirs {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+			continue
+		}
+		if !strings.HasPrefix(p, root+"/") {
+			return ""
+		}
+		return p
+	}
+	return ""
+}
+
+// isCSource returns true if the named file is something which might
+// #include other files.
+func isCSource(filename string) bool {
+	switch filepath.Ext(filename) {
+	case ".c", ".cc", ".cxx", ".cpp", ".m", ".h", ".hh", ".hpp", ".hxx", ".s", ".S", ".sx":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// jsonSchemaVersion is the version of the JSON output.  It is incremented
+// whenever a change is made which could break existing consumers, such as
+// removing or renaming a field.  Adding fields does not change it.
+const jsonSchemaVersion = 1
+
+// jsonOutput is the top-level JSON object.  Exactly one of Packages or
+// Variants is set, depending on whether --platform or --tag-set were used.
+type jsonOutput struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Packages      []jsonPackage `json:"packages,omitempty"`
+	Variants      []jsonVariant `json:"variants,omitempty"`
+}
+
+// jsonVariant is the set of packages for one platform and/or tag set.
+type jsonVariant struct {
+	GOOS     string        `json:"goos,omitempty"`
+	GOARCH   string        `json:"goarch,omitempty"`
+	TagSet   string        `json:"tagSet,omitempty"`
+	Tags     []string      `json:"tags,omitempty"`
+	Packages []jsonPackage `json:"packages"`
+}
+
+// jsonPackage describes a single package, or a test variant of one.
+// Packages are sorted by PkgPath, and each package's test variants follow it.
+type jsonPackage struct {
+	Kind        string      `json:"kind,omitempty"` // "test" for test variants
+	ID          string      `json:"id,omitempty"`   // only for test variants
+	PkgPath     string      `json:"pkgPath"`
+	Name        string      `json:"name,omitempty"`
+	Dir         string      `json:"dir,omitempty"`
+	RelDir      string      `json:"relDir,omitempty"` // only if under --relative-to
+	Files       jsonFiles   `json:"files"`
+	Imports     []string    `json:"imports,omitempty"`     // sorted package paths
+	TestImports []string    `json:"testImports,omitempty"` // only with --tests
+	Module      *jsonModule `json:"module,omitempty"`      // nil for the standard library
+	Stamps      jsonStamps  `json:"stamps"`
+	Errors      []string    `json:"errors,omitempty"`
+}
+
+// jsonFiles lists a package's files by kind.  All paths are absolute.
+type jsonFiles struct {
+	Go       []string `json:"go,omitempty"`       // Go files, after build constraints
+	Compiled []string `json:"compiled,omitempty"` // Go files passed to the compiler, e.g. after cgo
+	Other    []string `json:"other,omitempty"`    // non-Go sources, e.g. .c and .s files
+	Embed    []string `json:"embed,omitempty"`    // files matched by //go:embed
+	Include  []string `json:"include,omitempty"`  // local headers #included by C sources
+	Test     []string `json:"test,omitempty"`     // only with --tests
+}
+
+// jsonModule describes the module which holds a package.
+type jsonModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"` // "" for main modules
+	Dir     string `json:"dir,omitempty"`
+	Main    bool   `json:"main,omitempty"`
+}
+
+// jsonStamps are the paths of the make stamps for a package.  Stamps which
+// are not emitted for the package are omitted.
+type jsonStamps struct {
+	Files    string `json:"files,omitempty"`
+	Pkg      string `json:"pkg,omitempty"`
+	ByPath   string `json:"byPath,omitempty"`
+	Test     string `json:"test,omitempty"`
+	Generate string `json:"generate,omitempty"`
+}
+
+// emitJSON emits the packages in pkgMap as versioned JSON.
+func (emit emitter) emitJSON(out io.Writer, pkgMap map[string]*packages.Package) error {
+	return emitJSONValue(out, jsonOutput{
+		SchemaVersion: jsonSchemaVersion,
+		Packages:      emit.jsonPackages(pkgMap),
+	})
+}
+
+// emitJSONVariants emits versioned JSON for multiple platforms and/or tag
+// sets.
+func (emit emitter) emitJSONVariants(out io.Writer, variants []emitter, pkgMaps []map[string]*packages.Package) error {
+	result := jsonOutput{SchemaVersion: jsonSchemaVersion}
+	for i, v := range variants {
+		result.Variants = append(result.Variants, jsonVariant{
+			GOOS:     v.goos,
+			GOARCH:   v.goarch,
+			TagSet:   v.tagSet,
+			Tags:     v.tags,
+			Packages: v.jsonPackages(pkgMaps[i]),
+		})
+	}
+	return emitJSONValue(out, result)
+}
+
+// jsonPackages returns the records for the packages in pkgMap, sorted.
+func (emit emitter) jsonPackages(pkgMap map[string]*packages.Package) []jsonPackage {
+	result := []jsonPackage{}
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		result = append(result, emit.jsonPackage(pkg, pkgMap))
+	})
+	return result
+}
+
+// jsonPackage returns the record for a single package or test variant.
+func (emit emitter) jsonPackage(pkg *packages.Package, pkgMap map[string]*packages.Package) jsonPackage {
+	sd := fmt.Sprintf("%s/by-pkg/%s", emit.stateDir, pkg.PkgPath)
+	jp := jsonPackage{
+		PkgPath: pkg.PkgPath,
+		Name:    pkg.Name,
+		Files: jsonFiles{
+			Go:       pkg.GoFiles,
+			Compiled: pkg.CompiledGoFiles,
+			Other:    pkg.OtherFiles,
+			Embed:    pkg.EmbedFiles,
+			Include:  emit.includesOf(pkg),
+		},
+	}
+	for _, e := range pkg.Errors {
+		jp.Errors = append(jp.Errors, e.Error())
+	}
+	for _, imp := range pkg.Imports {
+		jp.Imports = append(jp.Imports, imp.PkgPath)
+	}
+	sort.Strings(jp.Imports)
+	if m := pkg.Module; m != nil {
+		jp.Module = &jsonModule{Path: m.Path, Version: m.Version, Dir: m.Dir, Main: m.Main}
+	}
+
+	if len(pkg.GoFiles) > 0 {
+		jp.Dir = filepath.Dir(pkg.GoFiles[0])
+		if rel, isRel := maybeRelative(jp.Dir, emit.relPath); isRel {
+			jp.RelDir = rel
+		}
+	}
+
+	// Test variants are keyed by ID, and share the _test stamp of the
+	// package under test.
+	if forPkg, ok := testVariantOf(pkg); ok && isTestOf(pkg, forPkg) {
+		jp.Kind = "test"
+		jp.ID = pkg.ID
+		jp.Stamps.Test = fmt.Sprintf("%s/by-pkg/%s/_test", emit.stateDir, forPkg)
+		return jp
+	}
+
+	jp.Stamps.Pkg = sd + "/_pkg"
+	if len(pkg.GoFiles) > 0 {
+		jp.Stamps.Files = sd + "/_files"
+		if jp.RelDir != "" {
+			jp.Stamps.ByPath = fmt.Sprintf("%s/by-path/%s/_pkg", emit.stateDir, jp.RelDir)
+		}
+		if len(emit.goGenerates(pkg)) > 0 {
+			jp.Stamps.Generate = sd + "/_generate"
+		}
+	}
+
+	if emit.tests {
+		internal, external := testVariants(pkg, pkgMap)
+		seenFiles := map[string]bool{}
+		for _, f := range pkg.GoFiles {
+			seenFiles[f] = true
+		}
+		seenImps := map[string]bool{pkg.PkgPath: true}
+		for _, imp := range jp.Imports {
+			seenImps[imp] = true
+		}
+		for _, v := range []*packages.Package{internal, external} {
+			if v == nil {
+				continue
+			}
+			jp.Stamps.Test = sd + "/_test"
+			for _, f := range v.GoFiles {
+				if !seenFiles[f] {
+					seenFiles[f] = true
+					jp.Files.Test = append(jp.Files.Test, f)
+				}
+			}
+			for _, imp := range v.Imports {
+				if !seenImps[imp.PkgPath] {
+					seenImps[imp.PkgPath] = true
+					jp.TestImports = append(jp.TestImports, imp.PkgPath)
+				}
+			}
+		}
+		sort.Strings(jp.Files.Test)
+		sort.Strings(jp.TestImports)
+	}
+	return jp
+}
+
+// ndjsonRecord is a single line of --output=ndjson.  It is a jsonPackage,
+// plus the schema version and the variant it belongs to, if any.
+type ndjsonRecord struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	GOOS          string `json:"goos,omitempty"`
+	GOARCH        string `json:"goarch,omitempty"`
+	TagSet        string `json:"tagSet,omitempty"`
+	jsonPackage
+}
+
+// emitNDJSON emits one JSON record per package, one per line.  Unlike
+// emitJSON, the records are written one at a time instead of being built
+// into one big JSON document.
+func (emit emitter) emitNDJSON(out io.Writer, pkgMap map[string]*packages.Package) error {
+	bw := bufio.NewWriter(out)
+	enc := json.NewEncoder(bw)
+	for _, k := range keys(pkgMap) {
+		pkg := pkgMap[k]
+		rec := ndjsonRecord{
+			SchemaVersion: jsonSchemaVersion,
+			GOOS:          emit.goos,
+			GOARCH:        emit.goarch,
+			TagSet:        emit.tagSet,
+			jsonPackage:   emit.jsonPackage(pkg, pkgMap),
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
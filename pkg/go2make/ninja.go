@@ -0,0 +1,153 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// ninjaEscaper escapes paths for use in ninja build statements.
+var ninjaEscaper = strings.NewReplacer("$", "$$", " ", "$ ", ":", "$:")
+
+// emitNinja emits a ninja file with the same stamps as emitMake.
+func (emit emitter) emitNinja(out io.Writer, pkgMap map[string]*packages.Package) {
+	emit.emitNinjaHeader(out)
+	emit.emitNinjaRules(out, pkgMap)
+}
+
+// emitNinjaVariants emits a ninja file for multiple platforms and/or tag
+// sets, each in its own state dir.
+func (emit emitter) emitNinjaVariants(out io.Writer, variants []emitter, pkgMaps []map[string]*packages.Package) {
+	emit.emitNinjaHeader(out)
+	for i, v := range variants {
+		fmt.Fprintf(out, "# %s\n", v.label())
+		fmt.Fprintf(out, "\n")
+		v.emitNinjaRules(out, pkgMaps[i])
+	}
+}
+
+func (emit emitter) emitNinjaHeader(out io.Writer) {
+	// Each of the rules which mirror make's cmp trick uses restat, so that
+	// ninja notices when the output was not changed and does not rebuild
+	// things which depend on it.
+	fmt.Fprintf(out, "# This file is autogenerated.\n")
+	fmt.Fprintf(out, "\n")
+	if emit.stampMode == "hash" {
+		fmt.Fprintf(out, "# This variable is the command used to hash the inputs of stamp files.\n")
+		fmt.Fprintf(out, "go2make_hash = sha256sum\n")
+		fmt.Fprintf(out, "\n")
+	}
+	fmt.Fprintf(out, "rule go2make_stamp\n")
+	if emit.stampMode == "hash" {
+		fmt.Fprintf(out, "  command = mkdir -p $$(dirname $out) && cat /dev/null $in | $go2make_hash > $out.tmp && %s\n", ninjaUpdate)
+		fmt.Fprintf(out, "  restat = 1\n")
+	} else {
+		fmt.Fprintf(out, "  command = mkdir -p $$(dirname $out) && touch $out\n")
+	}
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "rule go2make_alias\n")
+	fmt.Fprintf(out, "  command = mkdir -p $$(dirname $out) && touch $out\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "rule go2make_files\n")
+	fmt.Fprintf(out, "  command = mkdir -p $$(dirname $out) && ls $in | grep -E '%s' | LC_ALL=C sort > $out.tmp && %s\n", srcFileRE, ninjaUpdate)
+	fmt.Fprintf(out, "  restat = 1\n")
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "rule go2make_toolchain\n")
+	fmt.Fprintf(out, "  command = mkdir -p $$(dirname $out) && ($env go env %s; echo 'tags: $tags') > $out.tmp && %s\n", strings.Join(toolchainEnv, " "), ninjaUpdate)
+	fmt.Fprintf(out, "  restat = 1\n")
+	fmt.Fprintf(out, "\n")
+}
+
+// ninjaUpdate is the end of a ninja command which replaces $out with
+// $out.tmp only if they differ, like the cmp trick in make rules.
+const ninjaUpdate = "{ cmp -s $out.tmp $out || cat $out.tmp > $out; } && rm -f $out.tmp"
+
+// emitNinjaBuild emits a single ninja build statement.
+func emitNinjaBuild(out io.Writer, target, rule string, inputs, implicit []string) {
+	fmt.Fprintf(out, "build %s: %s", ninjaEscaper.Replace(target), rule)
+	for _, in := range inputs {
+		fmt.Fprintf(out, " $\n    %s", ninjaEscaper.Replace(in))
+	}
+	if len(implicit) > 0 {
+		fmt.Fprintf(out, " |")
+		for _, in := range implicit {
+			fmt.Fprintf(out, " $\n    %s", ninjaEscaper.Replace(in))
+		}
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+// emitNinjaRules emits all of the build statements for a single set of
+// packages.
+func (emit emitter) emitNinjaRules(out io.Writer, pkgMap map[string]*packages.Package) {
+	// A phony target with no inputs is always out of date, like make's
+	// _force.
+	emitNinjaBuild(out, emit.stateDir+"/_force", "phony", nil, nil)
+	fmt.Fprintf(out, "\n")
+	emitNinjaBuild(out, emit.stateDir+"/_toolchain", "go2make_toolchain", nil, []string{emit.stateDir + "/_force"})
+	if env := emit.platformEnv(); env != "" {
+		fmt.Fprintf(out, "  env = %s\n", env)
+	}
+	if len(emit.tags) > 0 {
+		fmt.Fprintf(out, "  tags = %s\n", strings.Join(emit.tags, ","))
+	}
+	fmt.Fprintf(out, "\n")
+
+	for _, mod := range modules(pkgMap) {
+		emitNinjaBuild(out, fmt.Sprintf("%s/by-mod/%s/_mod", emit.stateDir, mod.Path), "go2make_stamp", emit.modPrereqs(mod), nil)
+		fmt.Fprintf(out, "\n")
+	}
+
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if isTestNode(pkg) {
+			return
+		}
+
+		codeDir := ""
+		isRel := false
+		if len(pkg.GoFiles) > 0 {
+			codeDir, isRel = maybeRelative(filepath.Dir(pkg.GoFiles[0]), emit.relPath)
+			emitNinjaBuild(out, fmt.Sprintf("%s/by-pkg/%s/_files", emit.stateDir, pkg.PkgPath), "go2make_files", []string{codeDir + "/"}, nil)
+			fmt.Fprintf(out, "\n")
+		}
+
+		stamps := map[string][]string{"_pkg": emit.pkgPrereqs(pkg, pkgMap)}
+		if emit.tests {
+			if prereqs := emit.testPrereqs(pkg, pkgMap); prereqs != nil {
+				stamps["_test"] = prereqs
+			}
+		}
+		for _, stamp := range []string{"_pkg", "_test"} {
+			prereqs, found := stamps[stamp]
+			if !found {
+				continue
+			}
+			byPkg := fmt.Sprintf("%s/by-pkg/%s/%s", emit.stateDir, pkg.PkgPath, stamp)
+			emitNinjaBuild(out, byPkg, "go2make_stamp", prereqs, nil)
+			fmt.Fprintf(out, "\n")
+			if isRel {
+				emitNinjaBuild(out, fmt.Sprintf("%s/by-path/%s/%s", emit.stateDir, codeDir, stamp), "go2make_alias", []string{byPkg}, nil)
+				fmt.Fprintf(out, "\n")
+			}
+		}
+	})
+}
@@ -0,0 +1,469 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+)
+
+// sbomModule is a module which is linked into a main package, as it would be
+// reported by `go version -m`.
+type sbomModule struct {
+	path    string
+	version string
+	main    bool
+	replace *packages.Module
+	sum     string // the go.sum hash, e.g. "h1:...", if known
+	deps    []string
+}
+
+// sbomGraph is the set of modules which are linked into a main package.
+type sbomGraph struct {
+	pkg     *packages.Package
+	root    *sbomModule
+	modules []*sbomModule // sorted by path, not including root
+}
+
+// mainPackages returns the main packages in pkgMap, sorted by path.
+func mainPackages(pkgMap map[string]*packages.Package) []*packages.Package {
+	mains := []*packages.Package{}
+	visitEach(pkgMap, func(pkg *packages.Package) {
+		if pkg.Name == "main" && !isTestNode(pkg) && pkg.Module != nil {
+			mains = append(mains, pkg)
+		}
+	})
+	return mains
+}
+
+// sbomGraph walks every package which is linked into the main package pkg,
+// and collects their modules, with module-level dependency edges.  This does
+// not use pkgMap, since --roots and --prune should not hide things from an
+// SBOM.
+func (emit emitter) sbomGraph(pkg *packages.Package, sums map[string]string) *sbomGraph {
+	byPath := map[string]*sbomModule{}
+	deps := map[string]map[string]bool{}
+	getMod := func(m *packages.Module) *sbomModule {
+		if sm := byPath[m.Path]; sm != nil {
+			return sm
+		}
+		sm := &sbomModule{path: m.Path, version: m.Version, main: m.Main, replace: m.Replace}
+		if !m.Main {
+			sm.sum = emit.moduleSum(m, sums)
+		}
+		byPath[m.Path] = sm
+		deps[m.Path] = map[string]bool{}
+		return sm
+	}
+
+	seen := map[*packages.Package]bool{}
+	var visit func(p *packages.Package)
+	visit = func(p *packages.Package) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		var from *sbomModule
+		if p.Module != nil {
+			from = getMod(p.Module)
+		}
+		visitEach(p.Imports, func(imp *packages.Package) {
+			if from != nil && imp.Module != nil && imp.Module.Path != from.path {
+				deps[from.path][getMod(imp.Module).path] = true
+			}
+			visit(imp)
+		})
+	}
+	visit(pkg)
+
+	g := &sbomGraph{pkg: pkg, root: byPath[pkg.Module.Path]}
+	for path, sm := range byPath {
+		for dep := range deps[path] {
+			sm.deps = append(sm.deps, dep)
+		}
+		sort.Strings(sm.deps)
+		if sm != g.root {
+			g.modules = append(g.modules, sm)
+		}
+	}
+	sort.Slice(g.modules, func(i, j int) bool {
+		return g.modules[i].path < g.modules[j].path
+	})
+	return g
+}
+
+// goSums reads the go.sum (and go.work.sum) files which apply to the main
+// module of pkg, and returns the hashes of module zips, keyed by
+// "path@version".  Missing files are not an error.
+func (emit emitter) goSums(pkg *packages.Package) map[string]string {
+	files := []string{}
+	if pkg.Module != nil && pkg.Module.GoMod != "" {
+		files = append(files, filepath.Join(filepath.Dir(pkg.Module.GoMod), "go.sum"))
+	}
+	if emit.goWork != "" && emit.goWork != "off" {
+		files = append(files, filepath.Join(filepath.Dir(emit.goWork), "go.work.sum"))
+	}
+
+	sums := map[string]string{}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			emit.debug("    can't read", name, ":", err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			f := strings.Fields(scanner.Text())
+			// Lines for go.mod files ("v1.2.3/go.mod") are not interesting.
+			if len(f) != 3 || strings.HasSuffix(f[1], "/go.mod") {
+				continue
+			}
+			sums[f[0]+"@"+f[1]] = f[2]
+		}
+		file.Close()
+	}
+	return sums
+}
+
+// moduleSum returns the go.sum hash of the code which is really used for m,
+// which is its replacement if it has one.  If it is not in sums, the hash is
+// read from the module cache, which `go mod download` populates.  Modules
+// which are replaced by local directories have no hash.
+func (emit emitter) moduleSum(m *packages.Module, sums map[string]string) string {
+	path, version := m.Path, m.Version
+	if m.Replace != nil {
+		path, version = m.Replace.Path, m.Replace.Version
+	}
+	if version == "" {
+		return ""
+	}
+	if sum := sums[path+"@"+version]; sum != "" {
+		return sum
+	}
+	if emit.modCache == "" {
+		return ""
+	}
+	epath, err := module.EscapePath(path)
+	if err != nil {
+		return ""
+	}
+	ever, err := module.EscapeVersion(version)
+	if err != nil {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(emit.modCache, "cache", "download", epath, "@v", ever+".ziphash"))
+	if err != nil {
+		emit.debug("    no hash for", path+"@"+version, ":", err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// purl returns the package URL of a module, or of a package within it.
+func purl(modPath, version, pkgPath string) string {
+	s := "pkg:golang/" + modPath
+	if version != "" {
+		s += "@" + version
+	}
+	if sub := strings.TrimPrefix(pkgPath, modPath+"/"); pkgPath != "" && sub != pkgPath {
+		s += "#" + sub
+	}
+	return s
+}
+
+// sbomTime returns the creation time for SBOMs.  SOURCE_DATE_EPOCH is
+// honored, for reproducible builds.
+func sbomTime() time.Time {
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(secs, 0).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
+// sbomGraphs returns the module graphs for all main packages in pkgMap.
+func (emit emitter) sbomGraphs(pkgMap map[string]*packages.Package) []*sbomGraph {
+	graphs := []*sbomGraph{}
+	for _, pkg := range mainPackages(pkgMap) {
+		emit.debug("SBOM for", pkg.PkgPath)
+		graphs = append(graphs, emit.sbomGraph(pkg, emit.goSums(pkg)))
+	}
+	return graphs
+}
+
+// sbomProperties returns the platform and tags as name-value pairs.
+func (emit emitter) sbomProperties() [][2]string {
+	props := [][2]string{}
+	if emit.goos != "" {
+		props = append(props, [2]string{"go2make:goos", emit.goos}, [2]string{"go2make:goarch", emit.goarch})
+	}
+	if len(emit.tags) > 0 {
+		props = append(props, [2]string{"go2make:tags", strings.Join(emit.tags, ",")})
+	}
+	return props
+}
+
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp  string        `json:"timestamp"`
+	Tools      []cdxTool     `json:"tools"`
+	Component  cdxComponent  `json:"component"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	BOMRef     string        `json:"bom-ref"`
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// emitCycloneDX emits a CycloneDX 1.4 SBOM for each main package in pkgMap,
+// one JSON document per line.
+func (emit emitter) emitCycloneDX(out io.Writer, pkgMap map[string]*packages.Package) error {
+	for _, g := range emit.sbomGraphs(pkgMap) {
+		if err := emitJSONValue(out, emit.cycloneDX(g, sbomTime())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (emit emitter) cycloneDX(g *sbomGraph, now time.Time) cdxBOM {
+	refs := map[string]string{}
+	component := func(sm *sbomModule, typ, pkgPath string) cdxComponent {
+		c := cdxComponent{
+			BOMRef:  purl(sm.path, sm.version, pkgPath),
+			Type:    typ,
+			Name:    sm.path,
+			Version: sm.version,
+			PURL:    purl(sm.path, sm.version, pkgPath),
+		}
+		if pkgPath != "" {
+			c.Name = pkgPath
+		}
+		if sm.sum != "" {
+			// This is a hash of the module's files, not of any artifact, so
+			// it is not one of the component's hashes.
+			c.Properties = append(c.Properties, cdxProperty{"go2make:sum", sm.sum})
+		}
+		if r := sm.replace; r != nil {
+			c.Properties = append(c.Properties, cdxProperty{"go2make:replace:path", r.Path})
+			if r.Version != "" {
+				c.Properties = append(c.Properties, cdxProperty{"go2make:replace:version", r.Version})
+			} else {
+				c.Properties = append(c.Properties, cdxProperty{"go2make:replace:dir", r.Dir})
+			}
+		}
+		refs[sm.path] = c.BOMRef
+		return c
+	}
+
+	bom := cdxBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: now.Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: "go2make"}},
+			Component: component(g.root, "application", g.pkg.PkgPath),
+		},
+		Components:   []cdxComponent{},
+		Dependencies: []cdxDependency{},
+	}
+	for _, p := range emit.sbomProperties() {
+		bom.Metadata.Properties = append(bom.Metadata.Properties, cdxProperty{p[0], p[1]})
+	}
+	for _, sm := range g.modules {
+		bom.Components = append(bom.Components, component(sm, "library", ""))
+	}
+	for _, sm := range append([]*sbomModule{g.root}, g.modules...) {
+		dep := cdxDependency{Ref: refs[sm.path], DependsOn: []string{}}
+		for _, d := range sm.deps {
+			dep.DependsOn = append(dep.DependsOn, refs[d])
+		}
+		bom.Dependencies = append(bom.Dependencies, dep)
+	}
+	return bom
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+	Comment          string            `json:"comment,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxIDRE matches characters which are not allowed in SPDX IDs.
+var spdxIDRE = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// emitSPDX emits an SPDX 2.3 SBOM for each main package in pkgMap, one JSON
+// document per line.
+func (emit emitter) emitSPDX(out io.Writer, pkgMap map[string]*packages.Package) error {
+	for _, g := range emit.sbomGraphs(pkgMap) {
+		if err := emitJSONValue(out, emit.spdx(g, sbomTime())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (emit emitter) spdx(g *sbomGraph, now time.Time) spdxDocument {
+	ids := map[string]string{}
+	pkg := func(sm *sbomModule, pkgPath string) spdxPackage {
+		name := sm.path
+		if pkgPath != "" {
+			name = pkgPath
+		}
+		p := spdxPackage{
+			Name:             name,
+			SPDXID:           "SPDXRef-Package-" + spdxIDRE.ReplaceAllString(name, "-"),
+			VersionInfo:      sm.version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl(sm.path, sm.version, pkgPath),
+			}},
+		}
+		if r := sm.replace; r != nil {
+			if r.Version != "" {
+				p.Comment = fmt.Sprintf("replaced by %s@%s", r.Path, r.Version)
+			} else {
+				p.Comment = fmt.Sprintf("replaced by %s", r.Dir)
+			}
+		}
+		if sm.sum != "" {
+			p.Comment = strings.TrimPrefix(p.Comment+"; go.sum "+sm.sum, "; ")
+		}
+		ids[sm.path] = p.SPDXID
+		return p
+	}
+
+	name := g.pkg.PkgPath
+	if l := emit.label(); l != "" {
+		name += " (" + l + ")"
+	}
+	root := pkg(g.root, g.pkg.PkgPath)
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        name,
+		CreationInfo: spdxCreationInfo{
+			Created:  now.Format(time.RFC3339),
+			Creators: []string{"Tool: go2make"},
+		},
+		Packages: []spdxPackage{root},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: root.SPDXID,
+		}},
+	}
+	for _, sm := range g.modules {
+		doc.Packages = append(doc.Packages, pkg(sm, ""))
+	}
+	for _, sm := range append([]*sbomModule{g.root}, g.modules...) {
+		for _, d := range sm.deps {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      ids[sm.path],
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: ids[d],
+			})
+		}
+	}
+
+	// The namespace must be unique per document, so it includes a hash of
+	// the contents.
+	h := sha256.New()
+	for _, p := range doc.Packages {
+		fmt.Fprintln(h, p.Name, p.VersionInfo, p.Comment)
+	}
+	fmt.Fprintln(h, name, doc.CreationInfo.Created)
+	doc.DocumentNamespace = fmt.Sprintf("https://spdx.org/spdxdocs/go2make/%s-%x", g.pkg.PkgPath, h.Sum(nil)[:8])
+	return doc
+}
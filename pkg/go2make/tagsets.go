@@ -0,0 +1,149 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// tagSet is a named set of build tags, from --tag-set.
+type tagSet struct {
+	name string
+	tags []string
+}
+
+// tagSetNameRE matches valid tag set names.  These are used as directory
+// names and in make variables, so they are kept simple.
+var tagSetNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// parseTagSets parses --tag-set values, which are of the form
+// "name:tag1,tag2".
+func parseTagSets(specs []string) ([]tagSet, error) {
+	sets := []tagSet{}
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		name, tags, _ := strings.Cut(spec, ":")
+		if !tagSetNameRE.MatchString(name) || strings.HasPrefix(name, "by-") {
+			return nil, fmt.Errorf("invalid tag set name in %q", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate tag set name %q", name)
+		}
+		seen[name] = true
+		ts := tagSet{name: name}
+		for _, t := range strings.Split(tags, ",") {
+			if t != "" {
+				ts.tags = append(ts.tags, t)
+			}
+		}
+		sets = append(sets, ts)
+	}
+	return sets, nil
+}
+
+// sharedPackages returns the keys of packages which are the same in every
+// one of pkgMaps - same files and same imports - and whose dependencies are
+// all shared, too.  The result includes the keys of test variants of shared
+// packages.
+func (emit emitter) sharedPackages(pkgMaps []map[string]*packages.Package) map[string]bool {
+	memo := map[string]bool{}
+	var isShared func(path string) bool
+	isShared = func(path string) bool {
+		if v, found := memo[path]; found {
+			return v
+		}
+		memo[path] = false // break cycles
+		pkg := pkgMaps[0][path]
+		if pkg == nil {
+			return false
+		}
+		for _, m := range pkgMaps[1:] {
+			if !emit.samePackage(pkg, m[path]) {
+				return false
+			}
+		}
+		internal, external := testVariants(pkg, pkgMaps[0])
+		for _, tv := range []*packages.Package{internal, external} {
+			if tv == nil {
+				continue
+			}
+			for _, m := range pkgMaps[1:] {
+				if !emit.samePackage(tv, m[tv.ID]) {
+					return false
+				}
+			}
+		}
+		for _, p := range []*packages.Package{pkg, internal, external} {
+			if p == nil {
+				continue
+			}
+			for _, imp := range p.Imports {
+				if imp.PkgPath == pkg.PkgPath {
+					continue // the in-package test variant
+				}
+				if _, found := pkgMaps[0][imp.PkgPath]; found && !isShared(imp.PkgPath) {
+					return false
+				}
+			}
+		}
+		memo[path] = true
+		return true
+	}
+
+	shared := map[string]bool{}
+	for k, pkg := range pkgMaps[0] {
+		if isTestNode(pkg) {
+			continue
+		}
+		if isShared(k) {
+			shared[k] = true
+			internal, external := testVariants(pkg, pkgMaps[0])
+			for _, tv := range []*packages.Package{internal, external} {
+				if tv != nil {
+					shared[tv.ID] = true
+				}
+			}
+		}
+	}
+	return shared
+}
+
+// samePackage returns true if a and b have the same source files and imports.
+func (emit emitter) samePackage(a, b *packages.Package) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !reflect.DeepEqual(emit.srcFiles(a), emit.srcFiles(b)) {
+		return false
+	}
+	return reflect.DeepEqual(importPaths(a), importPaths(b))
+}
+
+func importPaths(pkg *packages.Package) []string {
+	paths := make([]string, 0, len(pkg.Imports))
+	for _, imp := range pkg.Imports {
+		paths = append(paths, imp.PkgPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
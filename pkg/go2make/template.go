@@ -0,0 +1,139 @@
+/*
+Copyright 2026 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package go2make
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// templateData is the data passed to --template.  The template is executed
+// once for each platform and tag set (or just once, if there are none).
+type templateData struct {
+	SchemaVersion int           // same as the JSON output
+	StateDir      string        // e.g. ".go2make" or ".go2make/linux_amd64"
+	RelativeTo    string        // the absolute path of --relative-to
+	GOOS          string        // only with --platform
+	GOARCH        string        // only with --platform
+	TagSet        string        // only with --tag-set
+	Tags          []string      // the build tags
+	Packages      []jsonPackage // sorted by PkgPath, see the JSON output, without test variants
+}
+
+// templateFuncs returns the helper functions available to templates.
+func (emit emitter) templateFuncs(data *templateData) template.FuncMap {
+	return template.FuncMap{
+		// rel returns a path relative to --relative-to, if it is under it.
+		"rel": func(path string) string {
+			rel, _ := maybeRelative(path, emit.relPath)
+			return rel
+		},
+		// makeEscape escapes a string for use as a make target or
+		// prerequisite.
+		"makeEscape": makeEscape,
+		// topo returns the packages in dependency order: each package
+		// comes after the packages it imports.
+		"topo": topoSort,
+		// pkg returns the package with the given path, or nil.
+		"pkg": func(path string) *jsonPackage {
+			for i := range data.Packages {
+				if data.Packages[i].PkgPath == path {
+					return &data.Packages[i]
+				}
+			}
+			return nil
+		},
+		"join": strings.Join,
+		"base": filepath.Base,
+		"dir":  filepath.Dir,
+	}
+}
+
+// loadTemplate reads and parses a --template file.
+func (emit emitter) loadTemplate(filename string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// The funcs must be defined before parsing, but are replaced with ones
+	// bound to the data before executing.
+	return template.New(filepath.Base(filename)).Funcs(emit.templateFuncs(&templateData{})).Parse(string(text))
+}
+
+// emitTemplate executes tmpl with the packages in pkgMap.
+func (emit emitter) emitTemplate(out io.Writer, tmpl *template.Template, pkgMap map[string]*packages.Package) error {
+	data := &templateData{
+		SchemaVersion: jsonSchemaVersion,
+		StateDir:      emit.stateDir,
+		RelativeTo:    emit.relPath,
+		GOOS:          emit.goos,
+		GOARCH:        emit.goarch,
+		TagSet:        emit.tagSet,
+		Tags:          emit.tags,
+	}
+	// Test variants share their PkgPath with the package under test, which
+	// would confuse pkg and topo.
+	for _, jp := range emit.jsonPackages(pkgMap) {
+		if jp.Kind == "" {
+			data.Packages = append(data.Packages, jp)
+		}
+	}
+	return tmpl.Funcs(emit.templateFuncs(data)).Execute(out, data)
+}
+
+// makeEscaper escapes characters which are special in make targets and
+// prerequisites.
+var makeEscaper = strings.NewReplacer("$", "$$", " ", `\ `, "#", `\#`, ":", `\:`)
+
+func makeEscape(s string) string {
+	return makeEscaper.Replace(s)
+}
+
+// topoSort returns pkgs in dependency order, with imports before the
+// packages which import them.  Ties are broken by the input order, so sorted
+// input gives deterministic output.  Imports which are not in pkgs are
+// ignored.
+func topoSort(pkgs []jsonPackage) []jsonPackage {
+	byPath := map[string]int{}
+	for i, p := range pkgs {
+		byPath[p.PkgPath] = i
+	}
+	done := make([]bool, len(pkgs))
+	out := make([]jsonPackage, 0, len(pkgs))
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] {
+			return
+		}
+		done[i] = true // import cycles are not valid Go
+		for _, imp := range pkgs[i].Imports {
+			if j, found := byPath[imp]; found {
+				visit(j)
+			}
+		}
+		out = append(out, pkgs[i])
+	}
+	for i := range pkgs {
+		visit(i)
+	}
+	return out
+}